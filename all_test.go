@@ -1,15 +1,29 @@
 package socks4
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/wzshiming/socks4/protocol"
 )
 
 var testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
@@ -138,13 +152,15 @@ func TestBind(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	listener, err := dial.Listen(context.Background(), "tcp", ":10000")
+	port := strconv.Itoa(freePorts(t, 1).First)
+	listener, err := dial.Listen(context.Background(), "tcp", ":"+port)
 	if err != nil {
 		t.Fatal(err)
 	}
+	t.Cleanup(func() { listener.Close() })
 	go http.Serve(listener, nil)
 	time.Sleep(time.Second / 10)
-	resp, err := http.Get("http://127.0.0.1:10000")
+	resp, err := http.Get("http://127.0.0.1:" + port)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -166,15 +182,18 @@ func TestBindWithSerialAndParallel(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	listener, err := dial.Listen(context.Background(), "tcp", ":10001")
+	port := strconv.Itoa(freePorts(t, 1).First)
+	url := "http://127.0.0.1:" + port
+	listener, err := dial.Listen(context.Background(), "tcp", ":"+port)
 	if err != nil {
 		t.Fatal(err)
 	}
+	t.Cleanup(func() { listener.Close() })
 	go http.Serve(listener, nil)
 	time.Sleep(time.Second)
 
 	for i := 0; i < 3; i++ {
-		resp, err := http.Get("http://127.0.0.1:10001")
+		resp, err := http.Get(url)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -186,7 +205,7 @@ func TestBindWithSerialAndParallel(t *testing.T) {
 
 	for i := 0; i < numRequests; i++ {
 		go func() {
-			resp, err := http.Get("http://127.0.0.1:10001")
+			resp, err := http.Get(url)
 			if err != nil {
 				errCh <- err
 				return
@@ -224,3 +243,1916 @@ func TestSimpleServer(t *testing.T) {
 	}
 	resp.Body.Close()
 }
+
+func TestDialerBind(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strconv.Itoa(freePorts(t, 1).First)
+	bind, err := dial.Bind(context.Background(), "tcp", ":"+want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bind.Close() })
+
+	_, port, err := net.SplitHostPort(bind.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != want {
+		t.Fatalf("announced port %s, want %s", port, want)
+	}
+
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	conn, err := bind.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, want := conn.RemoteAddr().(*address).Port, peer.LocalAddr().(*net.TCPAddr).Port; got != want {
+		t.Fatalf("peer port %d, want %d", got, want)
+	}
+
+	_, err = peer.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q, want %q", buf, "ping")
+	}
+}
+
+func TestDialerBindAcceptCancel(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bind, err := dial.Bind(context.Background(), "tcp", ":"+strconv.Itoa(freePorts(t, 1).First))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bind.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+	_, err = bind.Accept(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestListenConcurrentAccept(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.ListenBacklog = 3
+
+	want := strconv.Itoa(freePorts(t, 1).First)
+	listener, err := dial.Listen(context.Background(), "tcp", ":"+want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != want {
+		t.Fatalf("announced port %s, want %s", port, want)
+	}
+	time.Sleep(time.Second / 10)
+
+	const numPeers = 3
+	for i := 0; i < numPeers; i++ {
+		peer, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+	}
+	for i := 0; i < numPeers; i++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		errCh <- err
+	}()
+	err = listener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Authentication = UserAuth("u")
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://x@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := testServer.Listener.Addr().String()
+	_, err = dial.Dial("tcp", target)
+	if !errors.Is(err, ErrInvalidUser) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidUser)
+	}
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("got %T, want %T", err, replyErr)
+	}
+	if replyErr.Code != InvalidUserReply || replyErr.Command != ConnectCommand || replyErr.Target != target {
+		t.Fatalf("unexpected reply error %#v", replyErr)
+	}
+}
+
+func TestServerPipelinedRequest(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The HTTP request is sent with the SOCKS request in a single write.
+	var buf bytes.Buffer
+	req, err := newRequest(ConnectCommand, testServer.Listener.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = protocol.WriteRequest(&buf, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("GET / HTTP/1.0\r\n\r\n")
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := protocol.ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Code != GrantedReply {
+		t.Fatalf("got %v, want %v", rep.Code, GrantedReply)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerUserIDTooLong(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.MaxUserIDLength = 8
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + strings.Repeat("u", 9) + "@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if !errors.Is(err, ErrRequestRejected) {
+		t.Fatalf("got %v, want %v", err, ErrRequestRejected)
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Handle(ConnectCommand, HandlerFunc(func(req *Request) error {
+		if req.DestinationAddr.Port != 7 {
+			return proxy.DefaultHandler(ConnectCommand).ServeSOCKS4(req)
+		}
+		// Serve an echo service in process.
+		err := req.Reply(GrantedReply, nil)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(req.Conn, req.Conn)
+		return err
+	}))
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4a://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dial.Dial("tcp", "echo.invalid:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q, want %q", buf, "ping")
+	}
+
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerVirtualDestination(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	status, err := proxy.ListenVirtual("status.proxy.internal:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Close()
+	go http.Serve(status, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("status"))
+	}))
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4a://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get("http://status.proxy.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "status" {
+		t.Fatalf("got %q, want %q", body, "status")
+	}
+}
+
+func TestServerRewrite(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Rewrites = []RewriteRule{
+		{
+			DestinationMatch: DestinationMatch{Host: "*.legacy.internal", Port: 80},
+			To:               testServer.Listener.Addr().String(),
+		},
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4a://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+	resp, err := cli.Get("http://db.legacy.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerRewriteRules(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	_, network, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewServer()
+	proxy.Sniff = true
+	proxy.Rewrites = []RewriteRule{
+		{DestinationMatch: DestinationMatch{Network: network}, To: testServer.Listener.Addr().String()},
+	}
+	// Rules check the requested port 80, not the port of the rewritten destination.
+	proxy.Rules = []Rule{
+		{DestinationMatch: DestinationMatch{Host: "*.blocked.example", Port: 80}, Deny: true},
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext:       dial.DialContext,
+		DisableKeepAlives: true,
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://192.0.2.1/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "www.allowed.example"
+	resp, err := cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req.Host = "www.blocked.example"
+	resp, err = cli.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request to denied host succeeded")
+	}
+}
+
+func TestDestinationMatch(t *testing.T) {
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		match DestinationMatch
+		addr  address
+		want  bool
+	}{
+		{DestinationMatch{}, address{Name: "example.com", Port: 80}, true},
+		{DestinationMatch{Host: "example.com"}, address{Name: "EXAMPLE.com.", Port: 80}, true},
+		{DestinationMatch{Host: "*.example.com"}, address{Name: "a.example.com", Port: 80}, true},
+		{DestinationMatch{Host: "*.example.com"}, address{Name: "example.com", Port: 80}, false},
+		{DestinationMatch{Host: "*", Port: 443}, address{Name: "example.com", Port: 80}, false},
+		{DestinationMatch{Network: network}, address{IP: net.IPv4(10, 1, 2, 3), Port: 80}, true},
+		{DestinationMatch{Network: network}, address{IP: net.IPv4(11, 1, 2, 3), Port: 80}, false},
+		{DestinationMatch{Network: network}, address{Name: "example.com", Port: 80}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.match.Match(&tt.addr); got != tt.want {
+			t.Errorf("%+v.Match(%v) = %v, want %v", tt.match, &tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	dir := t.TempDir()
+	c := &Capture{Dir: dir, MaxFileSize: captureMinFileSize, MaxFiles: 2}
+	packet := make([]byte, 30000)
+	for i := 0; i != 5; i++ {
+		if err := c.writePacket(time.Now(), packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d capture files, want 2", len(files))
+	}
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > c.MaxFileSize {
+			t.Errorf("%s has %d bytes, want at most %d", name, info.Size(), c.MaxFileSize)
+		}
+	}
+
+	// A size below a packet does not start a file per packet.
+	dir = t.TempDir()
+	c = &Capture{Dir: dir, MaxFileSize: 100}
+	for i := 0; i != 5; i++ {
+		if err := c.writePacket(time.Now(), make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.pcapng")); len(files) != 1 {
+		t.Errorf("got %d capture files, want 1", len(files))
+	}
+}
+
+func TestCaptureWriteError(t *testing.T) {
+	var logs bytes.Buffer
+	c := &Capture{Dir: filepath.Join(t.TempDir(), "missing")}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+	c.newFlow(addr, addr, nil, log.New(&logs, "", 0))
+	if err := c.Close(); err == nil {
+		t.Error("Close did not report the failed writes")
+	}
+	if n := strings.Count(logs.String(), "capture failed"); n != 1 {
+		t.Errorf("logged %d failures, want 1:\n%s", n, logs.String())
+	}
+}
+
+func TestServerCapture(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	dir := t.TempDir()
+	proxy := NewServer()
+	proxy.Capture = &Capture{
+		Dir:   dir,
+		Users: []string{"u"},
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://u@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext:       dial.DialContext,
+		DisableKeepAlives: true,
+	}
+	resp, err := cli.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cli.CloseIdleConnections()
+	time.Sleep(time.Second / 10)
+	err = proxy.Capture.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d capture files, want 1", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets [][]byte
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block")
+		}
+		typ := binary.LittleEndian.Uint32(data[0:])
+		size := binary.LittleEndian.Uint32(data[4:])
+		if int(size) > len(data) || binary.LittleEndian.Uint32(data[size-4:]) != size {
+			t.Fatalf("invalid block length %d", size)
+		}
+		if typ == 6 {
+			captured := binary.LittleEndian.Uint32(data[20:])
+			packets = append(packets, data[28:28+captured])
+		}
+		data = data[size:]
+	}
+	// SYN, SYN-ACK, ACK, request, response and the FIN handshake.
+	if len(packets) < 7 {
+		t.Fatalf("got %d packets, want at least 7", len(packets))
+	}
+	var request bool
+	for _, p := range packets {
+		if checksum(p[:20]) != 0 {
+			t.Fatalf("invalid IPv4 header checksum")
+		}
+		if bytes.Contains(p, []byte("GET / HTTP/1.1")) {
+			request = true
+		}
+	}
+	if !request {
+		t.Fatalf("request not captured")
+	}
+}
+
+func TestServerSniffDeny(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	proxy := NewServer()
+	proxy.Sniff = true
+	proxy.Rules = []Rule{
+		{DestinationMatch: DestinationMatch{Host: "*.blocked.example"}, Deny: true},
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext:       dial.DialContext,
+		DisableKeepAlives: true,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req.Host = "www.blocked.example"
+	resp, err = cli.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request to denied host succeeded")
+	}
+	if n := proxy.DialFailures()[DialPolicy]; n != 1 {
+		t.Errorf("got %d policy failures, want 1", n)
+	}
+}
+
+func TestServerSniffServerFirst(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write([]byte("220 ready\r\n"))
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	proxy := NewServer()
+	proxy.Sniff = true
+	proxy.SniffTimeout = 10 * time.Second
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The banner arrives without waiting for SniffTimeout.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	banner := make([]byte, len("220 ready\r\n"))
+	if _, err := io.ReadFull(conn, banner); err != nil {
+		t.Fatal(err)
+	}
+	if string(banner) != "220 ready\r\n" {
+		t.Fatalf("got banner %q", banner)
+	}
+	if _, err := conn.Write([]byte("EHLO x\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len("EHLO x\r\n"))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != "EHLO x\r\n" {
+		t.Errorf("got %q, want the echo", echo)
+	}
+}
+
+func TestServerSniffAllow(t *testing.T) {
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	sniffed := make(chan string, 2)
+	proxy := NewServer()
+	proxy.Sniff = true
+	proxy.Rules = []Rule{
+		{DestinationMatch: DestinationMatch{Host: "*.good.example"}},
+		{Deny: true},
+	}
+	proxy.Hooks = &Hooks{
+		OnClose: func(req *Request, stats SessionStats) {
+			sniffed <- stats.SniffedHost
+		},
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext:       dial.DialContext,
+		DisableKeepAlives: true,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "www.good.example"
+	resp, err := cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if host := <-sniffed; host != "www.good.example" {
+		t.Errorf("got sniffed host %q, want %q", host, "www.good.example")
+	}
+
+	req.Host = "www.bad.example"
+	resp, err = cli.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request to a host not allowed succeeded")
+	}
+}
+
+func TestSniffTLS(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Client(c1, &tls.Config{ServerName: "sni.example"}).Handshake()
+
+	buf := make([]byte, sniffBufferSize)
+	var n int
+	for {
+		i, err := c2.Read(buf[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += i
+		host, err := sniffHost(buf[:n])
+		if err == errSniffIncomplete {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != "sni.example" {
+			t.Fatalf("got %q, want %q", host, "sni.example")
+		}
+		return
+	}
+}
+
+func TestUserDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(path, []byte(`{
+		"classes": {"slow": 1024},
+		"users": {
+			"alice": {"commands": ["connect"], "class": "slow"},
+			"bob": {"rules": [{"host": "*.example.com"}, {"deny": true}]},
+			"carol": {"enabled": false}
+		}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadUserDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		cmd      Command
+		dest     address
+		want     bool
+	}{
+		{"alice", ConnectCommand, address{Name: "a.test", Port: 80}, true},
+		{"alice", BindCommand, address{IP: net.IPv4zero, Port: 80}, false},
+		{"bob", ConnectCommand, address{Name: "www.example.com", Port: 80}, true},
+		{"bob", ConnectCommand, address{Name: "a.test", Port: 80}, false},
+		{"carol", ConnectCommand, address{Name: "a.test", Port: 80}, false},
+		{"dave", ConnectCommand, address{Name: "a.test", Port: 80}, false},
+	}
+	for _, tt := range tests {
+		req := &Request{Command: tt.cmd, Username: tt.username, DestinationAddr: &tt.dest}
+		if got := db.AuthRequest(req); got != tt.want {
+			t.Errorf("AuthRequest(%s %s %v) = %v, want %v", tt.username, tt.cmd, &tt.dest, got, tt.want)
+		}
+	}
+
+	req := &Request{Command: ConnectCommand, Username: "alice", DestinationAddr: &address{Name: "a.test", Port: 80}}
+	db.AuthRequest(req)
+	if req.RateLimit != 1024 {
+		t.Errorf("got rate limit %d, want 1024", req.RateLimit)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go db.Watch(ctx, time.Second/100, nil)
+	err = os.WriteFile(path, []byte(`{"users": {"dave": {}}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !db.Auth(ConnectCommand, "dave"); i++ {
+		if i == 100 {
+			t.Fatal("user database not reloaded")
+		}
+		time.Sleep(time.Second / 100)
+	}
+	if db.Auth(ConnectCommand, "alice") {
+		t.Error("removed user still allowed")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	oldKey, newKey := []byte("old secret"), []byte("new secret")
+	now := time.Unix(1700000000, 0)
+	auth := &TokenAuth{
+		Keys: map[string][]byte{"k1": oldKey, "k2": newKey},
+		Now:  func() time.Time { return now },
+	}
+
+	valid, err := MintToken("k1", oldKey, Token{Principal: "team-a", Expiry: now.Add(time.Hour), Scopes: []string{"connect"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := MintToken("k2", newKey, Token{Principal: "team-a", Expiry: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := MintToken("k2", newKey, Token{Principal: "team-a", Expiry: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := MintToken("k2", []byte("guess"), Token{Principal: "team-a", Expiry: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := auth.Verify(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Principal != "team-a" {
+		t.Errorf("got principal %q, want %q", tok.Principal, "team-a")
+	}
+	if !auth.Auth(ConnectCommand, valid) || auth.Auth(BindCommand, valid) {
+		t.Error("scopes not applied")
+	}
+	if !auth.Auth(BindCommand, rotated) {
+		t.Error("token of the rotated key rejected")
+	}
+	if _, err := auth.Verify(expired); err != ErrTokenExpired {
+		t.Errorf("got %v, want %v", err, ErrTokenExpired)
+	}
+	if _, err := auth.Verify(forged); err != ErrTokenInvalid {
+		t.Errorf("got %v, want %v", err, ErrTokenInvalid)
+	}
+	if _, err := MintToken("k1", nil, Token{Principal: "team-a", Expiry: now.Add(time.Hour)}); err == nil {
+		t.Error("minted a token with an empty key")
+	}
+	if _, err := MintToken("k1", oldKey, Token{Principal: "team-a"}); err == nil {
+		t.Error("minted a token without an expiry")
+	}
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	var events eventRecorder
+	proxy := NewServer()
+	proxy.Authentication = auth
+	proxy.Events = &events
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.Username = forged
+	_, err = dial.Dial("tcp", testServer.Listener.Addr().String())
+	if !errors.Is(err, ErrInvalidUser) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidUser)
+	}
+	dial.Username = rotated
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions := proxy.Sessions(); len(sessions) != 1 || sessions[0].Username != "team-a" {
+		t.Errorf("got sessions %+v, want the principal as the username", sessions)
+	}
+	conn.Close()
+	for _, ev := range events.all() {
+		if ev.Username != "" && ev.Username != "team-a" {
+			t.Errorf("event %s has the username %q, want the principal", ev.Type, ev.Username)
+		}
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	path := filepath.Join(t.TempDir(), "quota.json")
+	quota, err := NewQuota(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota.Period = QuotaDaily
+	quota.Default = QuotaLimit{Bytes: 1000}
+	quota.Users = map[string]QuotaLimit{"bob": {Sessions: 1}}
+
+	listen, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	proxy := NewServer()
+	proxy.Quota = quota
+	proxy.Rules = []Rule{{DestinationMatch: DestinationMatch{Port: 1}, Deny: true}}
+	go proxy.Serve(listen)
+
+	dialTo := func(username, address string) (net.Conn, error) {
+		d, err := NewDialer("socks4://" + username + "@" + listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Dial("tcp", address)
+	}
+	dial := func(username string) (net.Conn, error) {
+		return dialTo(username, echo.Addr().String())
+	}
+
+	conn, err := dial("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write(make([]byte, 600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(io.Discard, conn)
+	conn.Close()
+	if n >= 600 {
+		t.Errorf("got %d bytes, want the session cut before 600", n)
+	}
+	if _, err := dial("alice"); !errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want %v", err, ErrRequestRejected)
+	}
+
+	// A denied request does not count as a session.
+	if _, err := dialTo("bob", "127.0.0.1:1"); !errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want %v", err, ErrRequestRejected)
+	}
+	conn, err = dial("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := dial("bob"); !errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want %v", err, ErrRequestRejected)
+	}
+
+	if err := quota.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewQuota(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.Period = QuotaDaily
+	if got := loaded.Usage("alice"); got.Bytes < 1000 || got.Sessions != 1 {
+		t.Errorf("got alice usage %+v after reload", got)
+	}
+	if got := loaded.Usage("bob"); got.Sessions != 1 {
+		t.Errorf("got bob usage %+v after reload", got)
+	}
+	loaded.Now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	if got := loaded.Usage("alice"); got != (QuotaUsage{}) {
+		t.Errorf("got alice usage %+v in the next period", got)
+	}
+}
+
+func TestServerClientRulesAndBans(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	bans := &BanList{MaxFailures: 2}
+	proxy := NewServer()
+	proxy.Bans = bans
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() error {
+		cli := testServer.Client()
+		cli.Transport = &http.Transport{
+			DialContext:       dial.DialContext,
+			DisableKeepAlives: true,
+		}
+		resp, err := cli.Get(testServer.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	for i := 0; i != 2; i++ {
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{5, 1, 0, 80, 127, 0, 0, 1, 0})
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+	if !bans.Banned(ip) {
+		t.Fatal("client not banned")
+	}
+	if got := bans.Bans(); len(got) != 1 || !got[0].IP.Equal(ip) {
+		t.Errorf("got bans %v", got)
+	}
+	if err := get(); err == nil {
+		t.Error("banned client served")
+	}
+	if !bans.Lift(ip) {
+		t.Error("ban not lifted")
+	}
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+
+	denied := NewServer()
+	denied.ClientRules = []ClientRule{{Network: loopback, Deny: true}}
+	client, server := net.Pipe()
+	defer client.Close()
+	go denied.ServeConn(&remoteAddrConn{Conn: server, addr: &net.TCPAddr{IP: ip, Port: 1}})
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestWebhookAuth(t *testing.T) {
+	var calls int32
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var q AuthQuery
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		allow := q.Username == "alice" && q.Command == "connect" && q.Destination == "a.test:80"
+		json.NewEncoder(rw).Encode(map[string]bool{"allow": allow})
+	}))
+	defer hook.Close()
+
+	auth := &WebhookAuth{
+		URL:      hook.URL,
+		Header:   http.Header{"Authorization": {"Bearer secret"}},
+		CacheTTL: time.Minute,
+	}
+	req := func(username string) *Request {
+		return &Request{Command: ConnectCommand, Username: username, DestinationAddr: &address{Name: "a.test", Port: 80}}
+	}
+	if !auth.AuthRequest(req("alice")) || !auth.AuthRequest(req("alice")) {
+		t.Error("alice rejected")
+	}
+	if auth.AuthRequest(req("bob")) {
+		t.Error("bob allowed")
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+
+	failing := &WebhookAuth{URL: hook.URL}
+	if failing.AuthRequest(req("alice")) {
+		t.Error("fail-closed allowed a failed request")
+	}
+	failing = &WebhookAuth{URL: hook.URL, FailOpen: true}
+	if !failing.AuthRequest(req("bob")) {
+		t.Error("fail-open rejected a failed request")
+	}
+
+	// The call is abandoned with the session.
+	stop := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer slow.Close()
+	defer close(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ended := req("alice")
+	ended.ctx = ctx
+	start := time.Now()
+	if (&WebhookAuth{URL: slow.URL}).AuthRequest(ended) {
+		t.Error("allowed a request whose session ended")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("waited for the endpoint after the session ended")
+	}
+	if (&WebhookAuth{URL: slow.URL, FailOpen: true}).AuthRequest(ended) {
+		t.Error("fail-open allowed a request whose session ended")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+	expired := req("alice")
+	expired.ctx = ctx
+	if (&WebhookAuth{URL: slow.URL, FailOpen: true}).AuthRequest(expired) {
+		t.Error("fail-open allowed a request past the deadline of its session")
+	}
+	if !(&WebhookAuth{URL: slow.URL, Timeout: time.Second / 10, FailOpen: true}).AuthRequest(req("alice")) {
+		t.Error("fail-open rejected a request the endpoint timed out")
+	}
+}
+
+func TestExternalAuthCacheLimit(t *testing.T) {
+	var ext externalAuth
+	expires := time.Now().Add(time.Minute)
+	for i := 0; i < maxAuthCacheEntries+10; i++ {
+		ext.store(AuthQuery{Username: strconv.Itoa(i)}, true, expires)
+		if i == maxAuthCacheEntries-1 {
+			ext.cached(AuthQuery{Username: "0"}, time.Now())
+		}
+	}
+	if len(ext.entries) != maxAuthCacheEntries || ext.lru.Len() != maxAuthCacheEntries {
+		t.Fatalf("got %d cached decisions, want %d", len(ext.entries), maxAuthCacheEntries)
+	}
+	if _, ok := ext.cached(AuthQuery{Username: "0"}, time.Now()); !ok {
+		t.Error("recently used decision dropped")
+	}
+	if _, ok := ext.cached(AuthQuery{Username: "1"}, time.Now()); ok {
+		t.Error("least recently used decision kept")
+	}
+}
+
+func TestExecAuth(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	auth := &ExecAuth{
+		Path: sh,
+		Args: []string{"-c", `grep -q '"username":"alice"'`},
+	}
+	if !auth.Auth(ConnectCommand, "alice") {
+		t.Error("alice rejected")
+	}
+	if auth.Auth(ConnectCommand, "bob") {
+		t.Error("bob allowed")
+	}
+
+	slow := &ExecAuth{Path: sh, Args: []string{"-c", "sleep 10"}, Timeout: time.Second / 10, FailOpen: true}
+	if !slow.Auth(ConnectCommand, "bob") {
+		t.Error("fail-open rejected a timed out request")
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	dir := t.TempDir()
+	events := &EventLog{Path: filepath.Join(dir, "events.jsonl"), Key: []byte("secret"), MaxFileSize: 1024}
+	defer events.Close()
+
+	var mut sync.Mutex
+	var posted []Event
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var batch []Event
+		json.NewDecoder(r.Body).Decode(&batch)
+		mut.Lock()
+		posted = append(posted, batch...)
+		mut.Unlock()
+	}))
+	defer hook.Close()
+	webhook := &EventWebhook{URL: hook.URL, BatchSize: 2}
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	proxy := NewServer()
+	proxy.Events = multiEventSink{events, webhook}
+	proxy.Rules = []Rule{{DestinationMatch: DestinationMatch{Host: "denied.test"}, Deny: true}}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4a://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i != 3; i++ {
+		conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if _, err := dial.Dial("tcp", "denied.test:80"); err == nil {
+		t.Fatal("denied destination connected")
+	}
+	// Wait for the sessions to be closed.
+	for i := 0; ; i++ {
+		var closed int
+		files, _ := filepath.Glob(events.Path + "*")
+		for _, name := range files {
+			data, _ := os.ReadFile(name)
+			closed += bytes.Count(data, []byte(`"type":"closed"`))
+		}
+		if closed == 4 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("events not written")
+		}
+		time.Sleep(time.Second / 100)
+	}
+	webhook.Close()
+	webhook.Close()
+
+	files, err := filepath.Glob(events.Path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("event log not rotated")
+	}
+	var all []byte
+	prev := ""
+	for _, name := range append(files, events.Path) {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev, err = VerifyEventLog(bytes.NewReader(data), events.Key, prev)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		all = append(all, data...)
+	}
+	for _, typ := range []EventType{EventAccepted, EventAuthenticated, EventConnected, EventDenied, EventClosed} {
+		if !bytes.Contains(all, []byte(`"type":"`+typ+`"`)) {
+			t.Errorf("no %s event", typ)
+		}
+	}
+
+	if prev != events.Head() {
+		t.Errorf("got last hash %s, want the head %s", prev, events.Head())
+	}
+	tampered := bytes.Replace(all, []byte(`"denied"`), []byte(`"closed"`), 1)
+	if _, err := VerifyEventLog(bytes.NewReader(tampered), events.Key, ""); !errors.Is(err, ErrEventChainBroken) {
+		t.Errorf("got %v, want %v", err, ErrEventChainBroken)
+	}
+	// Without the key the chain cannot be recomputed.
+	if _, err := VerifyEventLog(bytes.NewReader(all), nil, ""); !errors.Is(err, ErrEventChainBroken) {
+		t.Errorf("got %v without the key, want %v", err, ErrEventChainBroken)
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	if len(posted) == 0 || posted[0].Session == "" {
+		t.Errorf("got posted events %v", posted)
+	}
+}
+
+// eventRecorder keeps the emitted events.
+type eventRecorder struct {
+	mut    sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Emit(ev *Event) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.events = append(r.events, *ev)
+	return nil
+}
+
+func (r *eventRecorder) all() []Event {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestEventLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	events := &EventLog{Path: filepath.Join(dir, "events.jsonl"), MaxFileSize: 200, MaxFiles: 2}
+	defer events.Close()
+	backup := events.Path + ".bak"
+	if err := os.WriteFile(backup, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i != 10; i++ {
+		err := events.Emit(&Event{Type: EventAccepted, Time: start.Add(time.Duration(i) * time.Second), Session: strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Errorf("rotation removed an unrelated file: %v", err)
+	}
+	rotated, err := events.rotated()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Errorf("got rotated files %q, want 2", rotated)
+	}
+}
+
+type multiEventSink []EventSink
+
+func (m multiEventSink) Emit(ev *Event) error {
+	for _, sink := range m {
+		if err := sink.Emit(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordTracer{}
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	proxy := NewServer()
+	proxy.Tracer = tracer
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4a://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial.Tracer = tracer
+	ctx, span := tracer.Start(context.Background(), "client")
+	_, port, _ := net.SplitHostPort(testServer.Listener.Addr().String())
+	conn, err := dial.DialContext(ctx, "tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span.End(nil)
+	conn.Close()
+
+	want := map[string]string{
+		SpanRequest:      "client",
+		SpanProxyDial:    SpanRequest,
+		SpanRequestWrite: SpanRequest,
+		SpanReplyRead:    SpanRequest,
+		SpanHandshake:    SpanSession,
+		SpanAuth:         SpanSession,
+		SpanDial:         SpanSession,
+		SpanResolve:      SpanDial,
+		SpanReply:        SpanSession,
+		SpanTunnel:       SpanSession,
+	}
+	for i := 0; ; i++ {
+		got := tracer.ended()
+		if _, ok := got[SpanSession]; ok {
+			for name, parent := range want {
+				if got[name] != parent {
+					t.Errorf("span %s has parent %q, want %q", name, got[name], parent)
+				}
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatal("session span not ended")
+		}
+		time.Sleep(time.Second / 100)
+	}
+}
+
+type recordTracer struct {
+	mut   sync.Mutex
+	spans map[string]string
+}
+
+type recordSpanKey struct{}
+
+type recordSpan struct {
+	tracer       *recordTracer
+	name, parent string
+}
+
+func (r *recordTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(recordSpanKey{}).(string)
+	return context.WithValue(ctx, recordSpanKey{}, name), &recordSpan{tracer: r, name: name, parent: parent}
+}
+
+func (r *recordTracer) ended() map[string]string {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	spans := map[string]string{}
+	for k, v := range r.spans {
+		spans[k] = v
+	}
+	return spans
+}
+
+func (s *recordSpan) SetAttribute(key, value string) {}
+
+func (s *recordSpan) End(err error) {
+	s.tracer.mut.Lock()
+	defer s.tracer.mut.Unlock()
+	if s.tracer.spans == nil {
+		s.tracer.spans = map[string]string{}
+	}
+	s.tracer.spans[s.name] = s.parent
+}
+
+func TestServerHooks(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	var accepted, dialed int32
+	closed := make(chan SessionStats, 2)
+	target := testServer.Listener.Addr().(*net.TCPAddr)
+	proxy := NewServer()
+	proxy.Hooks = &Hooks{
+		OnAccept: func(conn net.Conn) error {
+			atomic.AddInt32(&accepted, 1)
+			return nil
+		},
+		OnRequest: func(req *Request) error {
+			if req.Username == "blocked" {
+				return errors.New("blocked user")
+			}
+			req.DestinationAddr = &address{IP: target.IP, Port: target.Port}
+			return nil
+		},
+		OnDial: func(req *Request, conn net.Conn) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			return conn, nil
+		},
+		OnClose: func(req *Request, stats SessionStats) {
+			closed <- stats
+		},
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4a://blocked@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial.Dial("tcp", "example.invalid:80"); !errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want %v", err, ErrRequestRejected)
+	}
+	if stats := <-closed; stats.Err == nil {
+		t.Error("rejected session closed without error")
+	}
+
+	dial.Username = "alice"
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext:       dial.DialContext,
+		DisableKeepAlives: true,
+	}
+	resp, err := cli.Get("http://example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	stats := <-closed
+	if stats.BytesIn == 0 || stats.BytesOut == 0 {
+		t.Errorf("got stats %+v, want bytes in both directions", stats)
+	}
+	if a, d := atomic.LoadInt32(&accepted), atomic.LoadInt32(&dialed); a != 2 || d != 1 {
+		t.Errorf("got %d accepted and %d dialed, want 2 and 1", a, d)
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	target := testServer.Listener.Addr().String()
+	proxy := NewServer()
+	proxy.Rewrites = []RewriteRule{
+		{DestinationMatch: DestinationMatch{Host: "sessions.test"}, To: target},
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4a://alice@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", "sessions.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Read(make([]byte, 1))
+
+	sessions := proxy.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	info, ok := proxy.Session(sessions[0].ID)
+	if !ok || info.Username != "alice" || info.Command != ConnectCommand || info.BytesIn == 0 || info.BytesOut == 0 ||
+		!strings.HasPrefix(info.Destination, target) {
+		t.Errorf("got session %+v", info)
+	}
+
+	if !proxy.CancelSession(info.ID) {
+		t.Fatal("session not found")
+	}
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(proxy.Sessions()) != 0; i++ {
+		if i == 100 {
+			t.Fatal("cancelled session still active")
+		}
+		time.Sleep(time.Second / 100)
+	}
+	if proxy.CancelSession(info.ID) {
+		t.Error("ended session cancelled")
+	}
+
+	// A BIND waiting for its peer is cancelled as well.
+	bind, err := dial.Bind(context.Background(), "tcp", "127.0.0.1:"+strconv.Itoa(freePorts(t, 1).First))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bind.Close() })
+	sessions = proxy.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	proxy.CancelSession(sessions[0].ID)
+	for i := 0; len(proxy.Sessions()) != 0; i++ {
+		if i == 100 {
+			t.Fatal("cancelled bind still active")
+		}
+		time.Sleep(time.Second / 100)
+	}
+}
+
+func TestServerSessionContext(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	dialed := make(chan context.Context, 1)
+	proxy := NewServer()
+	proxy.ProxyDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- ctx
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://alice@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", testServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := <-dialed
+
+	id, _ := SessionIDFromContext(ctx)
+	if _, ok := proxy.Session(id); !ok {
+		t.Errorf("no session %q", id)
+	}
+	if username, _ := UsernameFromContext(ctx); username != "alice" {
+		t.Errorf("got username %q, want %q", username, "alice")
+	}
+	if dest, _ := DestinationFromContext(ctx); dest == nil || dest.String() != testServer.Listener.Addr().String() {
+		t.Errorf("got destination %v, want %v", dest, testServer.Listener.Addr())
+	}
+	if client, _ := ClientAddrFromContext(ctx); client == nil || client.String() != conn.LocalAddr().String() {
+		t.Errorf("got client %v, want %v", client, conn.LocalAddr())
+	}
+
+	conn.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("context not cancelled after the session ended")
+	}
+}
+
+func TestServerDialFailures(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().String()
+	closed.Close()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	proxy := NewServer()
+	proxy.DialTimeout = time.Second / 10
+	proxy.ResetOnDialFailure = []DialFailure{DialRefused}
+	proxy.ProxyDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "blackhole.test:80" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	proxy.Rules = []Rule{{DestinationMatch: DestinationMatch{Port: 25}, Deny: true}}
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4a://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial.Dial("tcp", "blackhole.test:80"); !errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want %v", err, ErrRequestRejected)
+	}
+	if _, err := dial.Dial("tcp", "mail.test:25"); !errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want %v", err, ErrRequestRejected)
+	}
+	if _, err := dial.Dial("tcp", refused); err == nil || errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want a reset connection", err)
+	}
+
+	want := map[DialFailure]int64{DialTimedOut: 1, DialPolicy: 1, DialRefused: 1}
+	for i := 0; ; i++ {
+		got := proxy.DialFailures()
+		if len(got) == len(want) && got[DialTimedOut] == 1 && got[DialPolicy] == 1 && got[DialRefused] == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("got dial failures %v, want %v", got, want)
+		}
+		time.Sleep(time.Second / 100)
+	}
+
+	dnsErr := &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "a.invalid", IsNotFound: true}}
+	if got := ClassifyDialError(dnsErr); got != DialDNSFailure {
+		t.Errorf("got %s, want %s", got, DialDNSFailure)
+	}
+}
+
+func TestServerStrictBind(t *testing.T) {
+	// The expected peer connects from 127.0.0.2, which not every system has.
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not a local address: %v", err)
+	}
+	l.Close()
+
+	newDialer := func(wait bool) *Dialer {
+		listen, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listen.Close() })
+		proxy := NewServer()
+		proxy.StrictBind = true
+		proxy.BindWaitForPeer = wait
+		go proxy.Serve(listen)
+		dial, err := NewDialer("socks4://" + listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dial
+	}
+	connectPeer := func(ip net.IP, bind *Binding) net.Conn {
+		_, port, _ := net.SplitHostPort(bind.Addr().String())
+		d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+		conn, err := d.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	stranger, expected := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)
+
+	bind, err := newDialer(false).Bind(context.Background(), "tcp", "127.0.0.2:20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if host, _, _ := net.SplitHostPort(bind.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("bind address %v, want the proxy IP for 0.0.0.0", bind.Addr())
+	}
+	conn := connectPeer(stranger, bind)
+	defer conn.Close()
+	if _, err := bind.Accept(context.Background()); !errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want %v", err, ErrRequestRejected)
+	}
+
+	bind, err = newDialer(true).Bind(context.Background(), "tcp", "127.0.0.2:20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	conn = connectPeer(stranger, bind)
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("peer from another IP not dropped")
+	}
+	peer := connectPeer(expected, bind)
+	defer peer.Close()
+	conn, err = bind.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServerBindPortsAndAdvertiseIP(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	advertised := net.IPv4(203, 0, 113, 7)
+	ports := freePorts(t, 2)
+	proxy := NewServer()
+	proxy.BindIP = net.IPv4(127, 0, 0, 1)
+	proxy.BindPorts = &ports
+	proxy.AdvertiseIP = advertised
+	go proxy.Serve(listen)
+
+	dial, err := NewDialer("socks4://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bound []int
+	for i := 0; i != 2; i++ {
+		// Different destinations, binds to the same one share a listener.
+		bind, err := dial.Bind(context.Background(), "tcp", "127.0.0.1:"+strconv.Itoa(20+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { bind.Close() })
+		host, port, _ := net.SplitHostPort(bind.Addr().String())
+		p, _ := strconv.Atoi(port)
+		if host != advertised.String() || !ports.Contains(p) {
+			t.Fatalf("bind address %v, want %v in %v", bind.Addr(), advertised, ports)
+		}
+		bound = append(bound, p)
+	}
+	if bound[0] == bound[1] {
+		t.Fatalf("both binds on port %d", bound[0])
+	}
+	if _, err := dial.Bind(context.Background(), "tcp", "127.0.0.1:22"); !errors.Is(err, ErrRequestRejected) {
+		t.Errorf("got %v, want %v with the port range in use", err, ErrRequestRejected)
+	}
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := newRequest(ConnectCommand, target.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteRequest(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := protocol.ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Code != GrantedReply || !rep.Addr.IP.Equal(advertised) {
+		t.Errorf("got %v %v, want %v %v", rep.Code, rep.Addr.IP, GrantedReply, advertised)
+	}
+}
+
+func TestServerRejectsSOCKS5Greeting(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	proxy := NewServer()
+	go proxy.Serve(listen)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("connection not closed after a SOCKS5 greeting")
+	}
+	if err == nil {
+		t.Error("got a reply to a SOCKS5 greeting")
+	}
+}
+
+// freePorts returns a range of n local TCP ports that are free, for the
+// listeners a test asks the proxy to open, so that repeated runs do not
+// collide with listeners the previous run left to the proxy.
+func freePorts(t *testing.T, n int) PortRange {
+	t.Helper()
+	for attempt := 0; attempt != 100; attempt++ {
+		first, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners := []net.Listener{first}
+		port := first.Addr().(*net.TCPAddr).Port
+		for i := 1; i < n; i++ {
+			l, err := net.Listen("tcp", ":"+strconv.Itoa(port+i))
+			if err != nil {
+				break
+			}
+			listeners = append(listeners, l)
+		}
+		for _, l := range listeners {
+			l.Close()
+		}
+		if len(listeners) == n {
+			return PortRange{First: port, Last: port + n - 1}
+		}
+	}
+	t.Fatalf("no %d free consecutive ports", n)
+	return PortRange{}
+}
@@ -1,5 +1,10 @@
 package socks4
 
+import (
+	"context"
+	"time"
+)
+
 // AuthenticationFunc Authentication interface is implemented
 type AuthenticationFunc func(cmd Command, username string) bool
 
@@ -19,3 +24,38 @@ func UserAuth(username string) Authentication {
 		return username == u
 	})
 }
+
+// RequestAuthentication is an Authentication that sees the whole request,
+// the server calls AuthRequest instead of Auth if it is implemented.
+// AuthRequest may set Request.RateLimit, and replace Request.Username with
+// the identity it verified.
+type RequestAuthentication interface {
+	Authentication
+	AuthRequest(req *Request) bool
+}
+
+// authenticateBy authenticates req with the context of the request done
+// at the deadline, if it is not zero.
+func (s *Server) authenticateBy(req *Request, deadline time.Time) bool {
+	if deadline.IsZero() {
+		return s.authenticate(req)
+	}
+	ctx := req.ctx
+	var cancel context.CancelFunc
+	req.ctx, cancel = context.WithDeadline(req.Context(), deadline)
+	defer func() {
+		cancel()
+		req.ctx = ctx
+	}()
+	return s.authenticate(req)
+}
+
+func (s *Server) authenticate(req *Request) bool {
+	if s.Authentication == nil {
+		return true
+	}
+	if ra, ok := s.Authentication.(RequestAuthentication); ok {
+		return ra.AuthRequest(req)
+	}
+	return s.Authentication.Auth(req.Command, req.Username)
+}
@@ -0,0 +1,173 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/socks4/protocol"
+)
+
+// BanList temporarily bans clients that fail Authentication, send malformed
+// requests or use the wrong version too often.
+// The fields must not be changed once the BanList is in use.
+type BanList struct {
+	// MaxFailures is the number of failures within FindTime that bans a client,
+	// the default is 5
+	MaxFailures int
+	// FindTime is the window in which failures are counted, the default is ten minutes
+	FindTime time.Duration
+	// BanTime is how long a client is banned, the default is one hour
+	BanTime time.Duration
+	// Now returns the current time, the default is time.Now
+	Now func() time.Time
+
+	mut     sync.Mutex
+	clients map[string]*banEntry
+}
+
+type banEntry struct {
+	failures int
+	since    time.Time
+	until    time.Time
+}
+
+// Ban is a banned client.
+type Ban struct {
+	IP    net.IP
+	Until time.Time
+}
+
+func (b *BanList) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+// Ban bans ip until the time.
+func (b *BanList) Ban(ip net.IP, until time.Time) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.clients == nil {
+		b.clients = map[string]*banEntry{}
+	}
+	b.clients[ip.String()] = &banEntry{until: until}
+}
+
+// Lift removes the ban and the failures of ip, and reports whether it was banned.
+func (b *BanList) Lift(ip net.IP) bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	e, ok := b.clients[ip.String()]
+	if !ok {
+		return false
+	}
+	delete(b.clients, ip.String())
+	return b.now().Before(e.until)
+}
+
+// Banned reports whether ip is banned.
+func (b *BanList) Banned(ip net.IP) bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	e, ok := b.clients[ip.String()]
+	return ok && b.now().Before(e.until)
+}
+
+// Bans returns the banned clients ordered by IP.
+func (b *BanList) Bans() []Ban {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	now := b.now()
+	var bans []Ban
+	for key, e := range b.clients {
+		if now.Before(e.until) {
+			bans = append(bans, Ban{IP: net.ParseIP(key), Until: e.until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP.String() < bans[j].IP.String()
+	})
+	return bans
+}
+
+// fail counts a failure of ip, and returns when the ban ends if it bans ip.
+func (b *BanList) fail(ip net.IP) (time.Time, bool) {
+	maxFailures := b.MaxFailures
+	if maxFailures <= 0 {
+		maxFailures = 5
+	}
+	findTime := b.FindTime
+	if findTime <= 0 {
+		findTime = 10 * time.Minute
+	}
+	banTime := b.BanTime
+	if banTime <= 0 {
+		banTime = time.Hour
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	now := b.now()
+	if b.clients == nil {
+		b.clients = map[string]*banEntry{}
+	}
+	b.prune(now, findTime)
+	key := ip.String()
+	e, ok := b.clients[key]
+	if !ok {
+		e = &banEntry{since: now}
+		b.clients[key] = e
+	} else if now.Sub(e.since) > findTime {
+		e.failures = 0
+		e.since = now
+	}
+	e.failures++
+	if e.failures < maxFailures {
+		return time.Time{}, false
+	}
+	e.failures = 0
+	e.since = now
+	e.until = now.Add(banTime)
+	return e.until, true
+}
+
+// prune removes the clients that are neither banned nor failing recently.
+func (b *BanList) prune(now time.Time, findTime time.Duration) {
+	for key, e := range b.clients {
+		if !now.Before(e.until) && now.Sub(e.since) > findTime {
+			delete(b.clients, key)
+		}
+	}
+}
+
+// isClientFault reports whether err is caused by a misbehaving client,
+// as opposed to network errors or failures of the destination.
+func isClientFault(err error) bool {
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		return false
+	}
+	switch serr.Phase {
+	case PhaseAuth:
+		return errors.Is(err, ErrUserAuthFailed)
+	case PhaseHandshake:
+		for _, e := range []error{
+			protocol.ErrInvalidVersion,
+			protocol.ErrInvalidPort,
+			protocol.ErrInvalidAddr,
+			protocol.ErrInvalidUserID,
+			protocol.ErrInvalidHostname,
+			protocol.ErrUserIDTooLong,
+			protocol.ErrHostnameTooLong,
+		} {
+			if errors.Is(err, e) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package socks4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// Contains reports whether the port is in the range.
+func (r PortRange) Contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+func (r PortRange) String() string {
+	return strconv.Itoa(r.First) + "-" + strconv.Itoa(r.Last)
+}
+
+// ParsePortRange parses a port range such as "40000-40100", or a single port.
+func ParsePortRange(s string) (PortRange, error) {
+	first, last := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	var r PortRange
+	var err error
+	if r.First, err = strconv.Atoi(first); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	if r.Last, err = strconv.Atoi(last); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	if r.First < 1 || r.Last > 65535 || r.First > r.Last {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return r, nil
+}
+
+// bindAllocated reports whether the server chooses the address of BIND
+// listeners instead of listening on DSTIP:DSTPORT.
+func (s *Server) bindAllocated() bool {
+	return s.BindIP != nil || s.BindPorts != nil
+}
+
+// allocateListenBind listens for a BIND on BindIP, on the next free port of
+// BindPorts, or on an ephemeral port without BindPorts.
+func (s *Server) allocateListenBind(ctx context.Context) (net.Listener, error) {
+	host := "0.0.0.0"
+	if s.BindIP != nil {
+		host = s.BindIP.String()
+	}
+	r := s.BindPorts
+	if r == nil {
+		return s.proxyListenBind(ctx, "tcp", net.JoinHostPort(host, "0"))
+	}
+
+	// Start after the last allocated port, so ports are spread over the
+	// range and one still held by a closing listener is not retried first.
+	n := uint32(r.Last - r.First + 1)
+	start := s.bindPortNext.Add(1) - 1
+	for i := uint32(0); i < n; i++ {
+		port := r.First + int((start+i)%n)
+		listener, err := s.proxyListenBind(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			s.bindPortNext.Store(start + i + 1)
+			return listener, nil
+		}
+		if !isAddrInUse(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w in %v on %s", ErrNoBindPort, r, host)
+}
+
+// advertise returns the address of a granted reply, with AdvertiseIP
+// in place of the local IP if it is set.
+func (s *Server) advertise(addr *address) *address {
+	if s.AdvertiseIP == nil || addr == nil {
+		return addr
+	}
+	return &address{IP: s.AdvertiseIP, Port: addr.Port}
+}
@@ -0,0 +1,453 @@
+package socks4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Capture writes the traffic of selected tunnels to pcapng files,
+// with synthesized IP and TCP headers so that they open in Wireshark.
+//
+// A session is captured if it matches any of Users, Clients or Destinations,
+// or always if all of them are empty.
+type Capture struct {
+	// Dir is the directory of the capture files
+	Dir string
+	// Users selects sessions by USERID
+	Users []string
+	// Clients selects sessions by client IP
+	Clients []*net.IPNet
+	// Destinations selects sessions by requested destination
+	Destinations []DestinationMatch
+	// MaxFileSize starts a new file once the current one exceeds this many bytes,
+	// 0 means no limit. Sizes too small for the largest packet are raised to fit it
+	MaxFileSize int64
+	// MaxFiles removes the oldest files written by the Capture beyond this count,
+	// 0 means no limit
+	MaxFiles int
+
+	mut   sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	size  int64
+	files []string
+	seq   int
+	// flushing is set while a flush of the buffered packets is scheduled
+	flushing bool
+	// err is the first failure to write, returned by Close
+	err error
+}
+
+const (
+	pcapngSectionHeaderBlock  = 0x0A0D0D0A
+	pcapngInterfaceDescBlock  = 0x00000001
+	pcapngEnhancedPacketBlock = 0x00000006
+	pcapngByteOrderMagic      = 0x1A2B3C4D
+	pcapngLinkTypeRaw         = 101
+	captureHeaderSize         = 28 + 20
+	captureMinFileSize        = captureHeaderSize + 32 + 65536
+	captureFlushInterval      = time.Second
+	captureMaxSegmentSize     = 65535 - 60 - 20
+	captureInitialSequence    = 1
+	captureWindow             = 65535
+	tcpFlagFIN                = 0x01
+	tcpFlagSYN                = 0x02
+	tcpFlagPSH                = 0x08
+	tcpFlagACK                = 0x10
+)
+
+// Selected reports whether the session of req is captured.
+func (c *Capture) Selected(req *Request) bool {
+	if len(c.Users) == 0 && len(c.Clients) == 0 && len(c.Destinations) == 0 {
+		return true
+	}
+	for _, u := range c.Users {
+		if u == req.Username {
+			return true
+		}
+	}
+	if len(c.Clients) != 0 {
+		if ip := addrIP(req.Conn.RemoteAddr()); ip != nil {
+			for _, n := range c.Clients {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	dest := req.DestinationAddr
+	if req.OriginalDestinationAddr != nil {
+		dest = req.OriginalDestinationAddr
+	}
+	for i := range c.Destinations {
+		if c.Destinations[i].Match(dest) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close flushes and closes the current capture file. It returns the first
+// error writing the capture since the previous Close, if any.
+func (c *Capture) Close() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	err := c.closeFile()
+	if c.err != nil {
+		err = c.err
+		c.err = nil
+	}
+	return err
+}
+
+// fail records a failure to write, which is logged the first time.
+func (c *Capture) fail(err error, logger Logger) {
+	c.mut.Lock()
+	first := c.err == nil
+	if first {
+		c.err = err
+	}
+	c.mut.Unlock()
+	if first && logger != nil {
+		logger.Println("capture failed, packets are dropped:", err)
+	}
+}
+
+func (c *Capture) closeFile() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file = nil
+	c.w = nil
+	return err
+}
+
+// writePacket writes an IP packet as an enhanced packet block.
+func (c *Capture) writePacket(t time.Time, packet []byte) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	padded := (len(packet) + 3) &^ 3
+	blockLen := 32 + padded
+	if c.file == nil || (c.MaxFileSize > 0 && c.size+int64(blockLen) > c.maxFileSize()) {
+		if err := c.rotate(t); err != nil {
+			return err
+		}
+	}
+
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	var header [28]byte
+	binary.LittleEndian.PutUint32(header[0:], pcapngEnhancedPacketBlock)
+	binary.LittleEndian.PutUint32(header[4:], uint32(blockLen))
+	binary.LittleEndian.PutUint32(header[8:], 0)
+	binary.LittleEndian.PutUint32(header[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(header[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(packet)))
+	c.w.Write(header[:])
+	c.w.Write(packet)
+	var trailer [7]byte
+	c.w.Write(trailer[:padded-len(packet)])
+	binary.LittleEndian.PutUint32(trailer[:], uint32(blockLen))
+	_, err := c.w.Write(trailer[:4])
+	if err != nil {
+		return err
+	}
+	c.size += int64(blockLen)
+	if !c.flushing {
+		c.flushing = true
+		time.AfterFunc(captureFlushInterval, c.flush)
+	}
+	return nil
+}
+
+// maxFileSize is MaxFileSize raised to fit the headers and the largest packet,
+// so that a small MaxFileSize does not start a file per packet.
+func (c *Capture) maxFileSize() int64 {
+	if c.MaxFileSize < captureMinFileSize {
+		return captureMinFileSize
+	}
+	return c.MaxFileSize
+}
+
+// flush writes the buffered packets to the file. A failure stays in the
+// writer, so the next packet or Close reports it.
+func (c *Capture) flush() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.flushing = false
+	if c.w != nil {
+		c.w.Flush()
+	}
+}
+
+// rotate starts a new capture file, beginning with the section header
+// and interface description blocks.
+func (c *Capture) rotate(t time.Time) error {
+	if err := c.closeFile(); err != nil {
+		return err
+	}
+	c.seq++
+	name := filepath.Join(c.Dir, fmt.Sprintf("socks4-%s-%d.pcapng", t.Format("20060102-150405"), c.seq))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	c.file = file
+	c.w = bufio.NewWriter(file)
+	c.files = append(c.files, name)
+	if c.MaxFiles > 0 {
+		for len(c.files) > c.MaxFiles {
+			os.Remove(c.files[0])
+			c.files = c.files[1:]
+		}
+	}
+
+	var shb [28]byte
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeaderBlock)
+	binary.LittleEndian.PutUint32(shb[4:], 28)
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint16(shb[14:], 0)
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], 28)
+
+	var idb [20]byte
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterfaceDescBlock)
+	binary.LittleEndian.PutUint32(idb[4:], 20)
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint32(idb[16:], 20)
+
+	if _, err := c.w.Write(shb[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(idb[:]); err != nil {
+		return err
+	}
+	c.size = captureHeaderSize
+	return nil
+}
+
+// captureFlow synthesizes a TCP connection between the client and the target.
+type captureFlow struct {
+	c         *Capture
+	mut       sync.Mutex
+	client    *net.TCPAddr
+	server    *net.TCPAddr
+	clientSeq uint32
+	serverSeq uint32
+	ipID      uint16
+	logger    Logger
+}
+
+func (c *Capture) newFlow(client, server net.Addr, dest *address, logger Logger) *captureFlow {
+	f := &captureFlow{
+		c:         c,
+		logger:    logger,
+		client:    captureEndpoint(client, nil),
+		server:    captureEndpoint(server, dest),
+		clientSeq: captureInitialSequence,
+		serverSeq: captureInitialSequence,
+	}
+	if (f.client.IP.To4() == nil) != (f.server.IP.To4() == nil) {
+		f.client.IP = f.client.IP.To16()
+		f.server.IP = f.server.IP.To16()
+	}
+
+	now := time.Now()
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.segment(now, true, tcpFlagSYN, nil)
+	f.clientSeq++
+	f.segment(now, false, tcpFlagSYN|tcpFlagACK, nil)
+	f.serverSeq++
+	f.segment(now, true, tcpFlagACK, nil)
+	return f
+}
+
+func captureEndpoint(addr net.Addr, dest *address) *net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		ip := a.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.TCPAddr{IP: ip, Port: a.Port}
+	}
+	ep := &net.TCPAddr{IP: net.IPv4zero.To4()}
+	if dest != nil {
+		ep.Port = dest.Port
+		if ip4 := dest.IP.To4(); ip4 != nil {
+			ep.IP = ip4
+		} else if dest.IP != nil {
+			ep.IP = dest.IP
+		}
+	}
+	return ep
+}
+
+// data records bytes sent by the client if fromClient, otherwise by the target.
+func (f *captureFlow) data(fromClient bool, b []byte) {
+	now := time.Now()
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for len(b) > 0 {
+		n := len(b)
+		if n > captureMaxSegmentSize {
+			n = captureMaxSegmentSize
+		}
+		f.segment(now, fromClient, tcpFlagPSH|tcpFlagACK, b[:n])
+		if fromClient {
+			f.clientSeq += uint32(n)
+		} else {
+			f.serverSeq += uint32(n)
+		}
+		b = b[n:]
+	}
+}
+
+// close records the teardown of the connection.
+func (f *captureFlow) close() {
+	now := time.Now()
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.segment(now, true, tcpFlagFIN|tcpFlagACK, nil)
+	f.clientSeq++
+	f.segment(now, false, tcpFlagFIN|tcpFlagACK, nil)
+	f.serverSeq++
+	f.segment(now, true, tcpFlagACK, nil)
+}
+
+func (f *captureFlow) segment(t time.Time, fromClient bool, flags byte, payload []byte) {
+	src, dst := f.client, f.server
+	seq, ack := f.clientSeq, f.serverSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], captureWindow)
+	copy(tcp[20:], payload)
+
+	var packet []byte
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:], src.IP.To4())
+		copy(pseudo[4:], dst.IP.To4())
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+		f.ipID++
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(packet[4:], f.ipID)
+		binary.BigEndian.PutUint16(packet[6:], 0x4000)
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:], src.IP.To4())
+		copy(packet[16:], dst.IP.To4())
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet))
+	} else {
+		pseudo := make([]byte, 40)
+		copy(pseudo[0:], src.IP.To16())
+		copy(pseudo[16:], dst.IP.To16())
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+		binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6
+		packet[7] = 64
+		copy(packet[8:], src.IP.To16())
+		copy(packet[24:], dst.IP.To16())
+	}
+	packet = append(packet, tcp...)
+	if err := f.c.writePacket(t, packet); err != nil {
+		f.c.fail(err, f.logger)
+	}
+}
+
+// checksum is the internet checksum of the concatenated data.
+func checksum(data ...[]byte) uint16 {
+	var sum uint32
+	var odd bool
+	var last byte
+	for _, b := range data {
+		for _, v := range b {
+			if odd {
+				sum += uint32(last)<<8 | uint32(v)
+			} else {
+				last = v
+			}
+			odd = !odd
+		}
+	}
+	if odd {
+		sum += uint32(last) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// captureConn records the data read from the connection in the flow.
+type captureConn struct {
+	net.Conn
+	flow       *captureFlow
+	fromClient bool
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.flow.data(c.fromClient, p[:n])
+	}
+	return n, err
+}
+
+// captureSession wraps the client and target connections of a session if it is captured,
+// the returned function records the end of the session.
+func (s *Server) captureSession(req *Request, client, target net.Conn, dest *address) (net.Conn, net.Conn, func()) {
+	if s.Capture == nil || !s.Capture.Selected(req) {
+		return client, target, func() {}
+	}
+	flow := s.Capture.newFlow(client.RemoteAddr(), target.RemoteAddr(), dest, s.Logger)
+	client = &captureConn{Conn: client, flow: flow, fromClient: true}
+	target = &captureConn{Conn: target, flow: flow}
+	return client, target, flow.close
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *address:
+		return a.IP
+	}
+	return nil
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/wzshiming/socks4/protocol"
 )
 
 // Dialer is a SOCKS4 dialer.
@@ -28,6 +31,12 @@ type Dialer struct {
 	// Timeout is the maximum amount of time a dial will wait for
 	// a connect to complete. The default is no timeout
 	Timeout time.Duration
+	// Tracer traces the requests if it is not nil
+	Tracer Tracer
+	// ListenBacklog is the number of BIND requests a listener returned by
+	// Listen keeps outstanding, and so the number of inbound connections
+	// it can accept at once. The default is 1
+	ListenBacklog int
 }
 
 // NewDialer returns a new Dialer that dials through the provided
@@ -77,28 +86,104 @@ func (d *Dialer) Dial(network, address string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, address)
 }
 
+// Listen returns a listener that accepts connections through BIND requests on the proxy server.
 func (d *Dialer) Listen(ctx context.Context, network, address string) (net.Listener, error) {
 	switch network {
 	default:
 		return nil, fmt.Errorf("unsupported network %q", network)
 	case "tcp", "tcp4", "tcp6":
 	}
-	return &listener{ctx: ctx, d: d, address: address}, nil
+
+	ctx, cancel := context.WithCancel(ctx)
+	b, err := d.Bind(ctx, network, address)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	l := &listener{
+		ctx:     ctx,
+		cancel:  cancel,
+		d:       d,
+		network: network,
+		address: address,
+		addr:    b.Addr(),
+		conns:   make(chan net.Conn),
+		errs:    make(chan error),
+	}
+	backlog := d.ListenBacklog
+	if backlog < 1 {
+		backlog = 1
+	}
+	l.wg.Add(backlog)
+	go l.run(b)
+	for i := 1; i < backlog; i++ {
+		go l.run(nil)
+	}
+	return l, nil
+}
+
+// Bind asks the proxy server to listen for a single inbound connection on
+// behalf of the client. The returned Binding reports the address announced
+// by the proxy server, which is the address the peer must connect to, with
+// the IP of the proxy server if it announced 0.0.0.0.
+func (d *Dialer) Bind(ctx context.Context, network, address string) (*Binding, error) {
+	switch network {
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	case "tcp", "tcp4", "tcp6":
+	}
+	conn, addr, err := d.request(ctx, BindCommand, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Binding{conn: conn, addr: announcedAddr(addr, conn), target: address}, nil
+}
+
+// announcedAddr returns the address in the reply to a BIND, where 0.0.0.0
+// means the peer connects to the IP of the proxy server.
+func announcedAddr(addr net.Addr, conn net.Conn) net.Addr {
+	a, ok := addr.(*address)
+	if !ok || (a.IP != nil && !a.IP.IsUnspecified()) {
+		return addr
+	}
+	ip := addrIP(conn.RemoteAddr())
+	if ip == nil {
+		return addr
+	}
+	return &address{IP: ip, Port: a.Port}
 }
 
 // DialContext connects to the provided address on the provided network.
 func (d *Dialer) do(ctx context.Context, cmd Command, address string) (net.Conn, error) {
+	conn, _, err := d.request(ctx, cmd, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// request sends a request to the proxy server and reads the first reply.
+func (d *Dialer) request(ctx context.Context, cmd Command, address string) (_ net.Conn, _ net.Addr, err error) {
+	ctx, span := startSpan(d.Tracer, ctx, SpanRequest)
+	span.SetAttribute("command", commandName(cmd))
+	span.SetAttribute("destination", address)
+	defer func() {
+		span.End(err)
+	}()
+
 	if d.IsResolve {
 		host, port, err := net.SplitHostPort(address)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if host != "" {
 			ip := net.ParseIP(host)
 			if ip == nil {
-				ipaddr, err := d.resolver().LookupIP(ctx, "ip4", host)
+				resolveCtx, span := startSpan(d.Tracer, ctx, SpanLocalResolve)
+				ipaddr, err := d.resolver().LookupIP(resolveCtx, "ip4", host)
+				span.End(err)
 				if err != nil {
-					return nil, err
+					return nil, nil, err
 				}
 				host := ipaddr[0].String()
 				address = net.JoinHostPort(host, port)
@@ -106,21 +191,28 @@ func (d *Dialer) do(ctx context.Context, cmd Command, address string) (net.Conn,
 		}
 	}
 
-	conn, err := d.proxyDial(ctx, d.ProxyNetwork, d.ProxyAddress)
+	dialCtx, dialSpan := startSpan(d.Tracer, ctx, SpanProxyDial)
+	conn, err := d.proxyDial(dialCtx, d.ProxyNetwork, d.ProxyAddress)
+	dialSpan.End(err)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	_, err = d.connect(ctx, conn, cmd, address)
+	addr, err := d.connect(ctx, conn, cmd, address)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	return conn, nil
+	return conn, addr, nil
 }
 
 func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd Command, address string) (net.Addr, error) {
+	req, err := newRequest(cmd, address, d.Username)
+	if err != nil {
+		return nil, err
+	}
+
 	if d.Timeout != 0 {
 		deadline := time.Now().Add(d.Timeout)
 		if d, ok := ctx.Deadline(); !ok || deadline.Before(d) {
@@ -133,38 +225,38 @@ func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd Command, addres
 		conn.SetDeadline(deadline)
 		defer conn.SetDeadline(time.Time{})
 	}
+	stop := watchContext(ctx, conn)
 
-	_, err := conn.Write([]byte{socks4Version, byte(cmd)})
+	_, span := startSpan(d.Tracer, ctx, SpanRequestWrite)
+	err = protocol.WriteRequest(conn, req)
+	span.End(err)
 	if err != nil {
-		return nil, err
+		stop()
+		return nil, contextError(ctx, err)
 	}
-
-	err = writeAddrAndUserWithStr(conn, address, d.Username)
+	_, span = startSpan(d.Tracer, ctx, SpanReplyRead)
+	addr, err := readReply(conn, cmd, address)
+	span.End(err)
+	stop()
 	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	// The reply may have raced with cancellation, which poisons the deadline.
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	return d.readReply(conn)
+	return addr, nil
 }
 
-func (d *Dialer) readReply(conn net.Conn) (net.Addr, error) {
-	var header [2]byte
-	i, err := io.ReadFull(conn, header[:])
-	if err != nil {
-		return nil, err
-	}
-	if i != 2 {
-		return nil, errors.New("server does not respond properly")
-	}
-	addr, err := readAddr(conn)
+func readReply(conn net.Conn, cmd Command, target string) (net.Addr, error) {
+	rep, err := protocol.ReadReply(conn)
 	if err != nil {
 		return nil, err
 	}
-
-	rep := reply(header[1])
-	if rep != grantedReply {
-		return nil, fmt.Errorf("socks connection request failed: %s", rep)
+	if rep.Code != GrantedReply {
+		return nil, &ReplyError{Code: rep.Code, Command: cmd, Target: target}
 	}
-	return addr, nil
+	return &rep.Addr, nil
 }
 
 func (d *Dialer) resolver() *net.Resolver {
@@ -185,33 +277,179 @@ func (d *Dialer) proxyDial(ctx context.Context, network, address string) (net.Co
 
 type listener struct {
 	ctx     context.Context
+	cancel  context.CancelFunc
 	d       *Dialer
+	network string
 	address string
+	addr    net.Addr
+	conns   chan net.Conn
+	errs    chan error
+	wg      sync.WaitGroup
+	closed  atomic.Bool
+}
+
+// run keeps one BIND request outstanding until the listener is closed.
+func (l *listener) run(b *Binding) {
+	defer l.wg.Done()
+	var delay time.Duration
+	for {
+		conn, err := l.accept(b)
+		b = nil
+		if err != nil {
+			if l.ctx.Err() != nil {
+				return
+			}
+			select {
+			case l.errs <- err:
+			case <-l.ctx.Done():
+				return
+			}
+
+			// Back off like net/http does for temporary accept errors,
+			// so an unreachable proxy server does not cause a busy loop.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			select {
+			case <-time.After(delay):
+			case <-l.ctx.Done():
+				return
+			}
+			continue
+		}
+		delay = 0
+
+		select {
+		case l.conns <- conn:
+		case <-l.ctx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (l *listener) accept(b *Binding) (net.Conn, error) {
+	if b == nil {
+		var err error
+		b, err = l.d.Bind(l.ctx, l.network, l.address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Accept(l.ctx)
 }
 
 // Accept waits for and returns the next connection to the listener.
 func (l *listener) Accept() (net.Conn, error) {
-	conn, err := l.d.do(l.ctx, BindCommand, l.address)
-	if err != nil {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
 		return nil, err
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
 	}
-	addr, err := l.d.readReply(conn)
-	if err != nil {
-		return nil, err
-	}
-	return &connect{Conn: conn, remoteAddr: addr}, nil
 }
 
-// Close closes the listener.
+// Close closes the listener and cancels the outstanding BIND requests.
 func (l *listener) Close() error {
+	if l.closed.Swap(true) {
+		return net.ErrClosed
+	}
+	l.cancel()
+	l.wg.Wait()
 	return nil
 }
 
-// address returns the listener's network address.
+// Addr returns the address announced by the proxy server.
 func (l *listener) Addr() net.Addr {
-	return nil
+	return l.addr
+}
+
+// Binding is a pending BIND request. The proxy server is listening on Addr
+// and Accept waits for the peer to connect.
+type Binding struct {
+	conn     net.Conn
+	addr     net.Addr
+	target   string
+	accepted atomic.Bool
+}
+
+// Addr returns the address the proxy server announced it is listening on.
+func (b *Binding) Addr() net.Addr {
+	return b.addr
+}
+
+// Accept waits for the second reply of the proxy server and returns the
+// inbound connection, whose RemoteAddr is the address of the peer.
+// Accept can only be called once; the Binding is closed if it fails.
+func (b *Binding) Accept(ctx context.Context) (net.Conn, error) {
+	if b.accepted.Swap(true) {
+		return nil, errors.New("bind already accepted")
+	}
+	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
+		b.conn.SetReadDeadline(deadline)
+	}
+	stop := watchContext(ctx, b.conn)
+	addr, err := readReply(b.conn, BindCommand, b.target)
+	stop()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		b.conn.Close()
+		return nil, contextError(ctx, err)
+	}
+	b.conn.SetDeadline(time.Time{})
+	return &connect{Conn: b.conn, remoteAddr: addr}, nil
+}
+
+// Close closes the connection to the proxy server, which cancels the BIND request.
+func (b *Binding) Close() error {
+	return b.conn.Close()
+}
+
+// watchContext interrupts pending I/O on conn when ctx is done,
+// until the returned function is called.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
 }
 
+// contextError returns the error of ctx in preference to err
+// if ctx is done, since the I/O error was caused by watchContext.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate cancellation of I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
 type connect struct {
 	net.Conn
 	remoteAddr net.Addr
@@ -0,0 +1,1062 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wzshiming/socks4"
+	"github.com/wzshiming/socks4/protocol"
+)
+
+// Config is the configuration file of the server, in JSON or YAML.
+type Config struct {
+	Listeners []ListenerConfig `json:"listeners"`
+	// Users are the allowed USERIDs, any USERID is allowed if it is empty
+	Users []string `json:"users"`
+	// UserDB is a user database file, which replaces Users
+	UserDB *UserDBConfig `json:"user_db"`
+	// ExternalAuth forwards authentication to a webhook or an executable,
+	// which replaces Users and UserDB
+	ExternalAuth *ExternalAuthConfig `json:"external_auth"`
+	// Clients allow or deny clients by address, the first matching one applies
+	Clients []ClientConfig `json:"clients"`
+	// Bans temporarily bans failing clients, it is disabled if omitted
+	Bans *BansConfig `json:"bans"`
+	// ResetOnDialFailure are the classes of failed CONNECTs that reset the
+	// client connection instead of replying, "refused", "timeout",
+	// "unreachable", "dns", "policy" or "other"
+	ResetOnDialFailure []string `json:"reset_on_dial_failure"`
+	// AdvertiseIP is the IPv4 address sent in replies instead of the local
+	// one, for servers behind NAT
+	AdvertiseIP string          `json:"advertise_ip"`
+	Rules       []RuleConfig    `json:"rules"`
+	Rewrites    []RewriteConfig `json:"rewrites"`
+	Timeouts    TimeoutsConfig  `json:"timeouts"`
+	// Bind configures the BIND command
+	Bind BindConfig `json:"bind"`
+	Log  LogConfig  `json:"log"`
+	// Upstreams are proxies to dial through, "socks4://" or "socks4a://" URLs,
+	// each one is reached through the previous one
+	Upstreams []string `json:"upstreams"`
+	// Admin is the HTTP admin endpoint, it is disabled if omitted
+	Admin *AdminConfig `json:"admin"`
+	// Events is the audit event stream, it is disabled if omitted
+	Events *EventsConfig `json:"events"`
+}
+
+// BindConfig configures the BIND command.
+type BindConfig struct {
+	// Strict only accepts the peer from the IP in the request,
+	// see socks4.Server.StrictBind
+	Strict bool `json:"strict"`
+	// WaitForPeer keeps waiting after a peer from another IP
+	WaitForPeer bool `json:"wait_for_peer"`
+	// Interface is the IP, or the name of the interface whose first IPv4
+	// address is used, that BIND listeners are allocated on
+	Interface string `json:"interface"`
+	// Ports is the range BIND listeners are allocated from, such as "40000-40100"
+	Ports string `json:"ports"`
+}
+
+// bindIP returns the IP of Interface.
+func (b *BindConfig) bindIP() (net.IP, error) {
+	if ip := net.ParseIP(b.Interface); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(b.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", b.Interface)
+}
+
+// EventsConfig is where the audit events go, see socks4.EventLog and socks4.EventWebhook.
+type EventsConfig struct {
+	// File is the JSON Lines file
+	File        string `json:"file"`
+	MaxFileSize int64  `json:"max_file_size"`
+	MaxFiles    int    `json:"max_files"`
+	// KeyFile holds the HMAC key that chains the lines of File
+	KeyFile string `json:"key_file"`
+	// Webhook is the URL the events are posted to in batches
+	Webhook string `json:"webhook"`
+}
+
+// AdminConfig is the HTTP admin endpoint.
+type AdminConfig struct {
+	// Address is the listen address, which must be a loopback address
+	// unless Token is set
+	Address string `json:"address"`
+	// Token is the bearer token every request but /health must carry
+	Token string `json:"token"`
+}
+
+// UserDBConfig is a user database file, see socks4.UserDB.
+type UserDBConfig struct {
+	File string `json:"file"`
+	// WatchInterval is how often the file is checked for changes,
+	// the default is five seconds
+	WatchInterval Duration `json:"watch_interval"`
+}
+
+// ExternalAuthConfig forwards authentication, see socks4.WebhookAuth and socks4.ExecAuth.
+type ExternalAuthConfig struct {
+	// Webhook is the URL of the endpoint
+	Webhook string `json:"webhook"`
+	// Exec is the executable and its arguments
+	Exec     []string `json:"exec"`
+	Timeout  Duration `json:"timeout"`
+	CacheTTL Duration `json:"cache_ttl"`
+	FailOpen bool     `json:"fail_open"`
+}
+
+// ListenerConfig is an address to serve on.
+type ListenerConfig struct {
+	// Address is the listen address, such as ":1080", or the path of a unix socket
+	Address string `json:"address"`
+	// Scheme is "tcp", the default, or "unix"
+	Scheme string     `json:"scheme"`
+	TLS    *TLSConfig `json:"tls"`
+}
+
+// network returns the network of the listener.
+func (l *ListenerConfig) network() string {
+	if l.Scheme == "" {
+		return "tcp"
+	}
+	return l.Scheme
+}
+
+// TLSConfig serves a listener over TLS.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile requires client certificates signed by these CAs if it is not empty
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// MatchConfig matches destinations, see socks4.DestinationMatch.
+type MatchConfig struct {
+	Host string `json:"host"`
+	CIDR string `json:"cidr"`
+	Port int    `json:"port"`
+}
+
+// RuleConfig allows or denies destinations.
+type RuleConfig struct {
+	MatchConfig
+	// Action is "allow" or "deny"
+	Action string `json:"action"`
+}
+
+// ClientConfig allows or denies clients.
+type ClientConfig struct {
+	// CIDR matches the client address, any client if it is empty
+	CIDR string `json:"cidr"`
+	// Action is "allow" or "deny"
+	Action string `json:"action"`
+}
+
+// BansConfig bans failing clients, see socks4.BanList.
+type BansConfig struct {
+	MaxFailures int      `json:"max_failures"`
+	FindTime    Duration `json:"find_time"`
+	BanTime     Duration `json:"ban_time"`
+}
+
+// RewriteConfig redirects destinations.
+type RewriteConfig struct {
+	MatchConfig
+	To string `json:"to"`
+}
+
+// TimeoutsConfig are the timeouts of the server.
+type TimeoutsConfig struct {
+	Handshake Duration `json:"handshake"`
+	Idle      Duration `json:"idle"`
+	Dial      Duration `json:"dial"`
+	// BindReuse is half a second if it is omitted
+	BindReuse  *Duration `json:"bind_reuse"`
+	BindAccept Duration  `json:"bind_accept"`
+}
+
+// LogConfig is where the server logs.
+type LogConfig struct {
+	// File is the log file, the default is stderr
+	File string `json:"file"`
+	// Prefix is the prefix of log lines, the default is "[socks4] "
+	Prefix *string `json:"prefix"`
+}
+
+// Duration is a time.Duration written as a string such as "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ConfigError is an error at a location in the configuration file.
+type ConfigError struct {
+	File string
+	Line int
+	Col  int
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line != 0 {
+		fmt.Fprintf(&b, ":%d:%d", e.Line, e.Col)
+	}
+	if e.Path != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Path)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors are all errors found in a configuration file.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// sort orders the errors by their position in the file,
+// errors without a position first.
+func (e ConfigErrors) sort() {
+	sort.SliceStable(e, func(i, j int) bool {
+		if e[i].Line != e[j].Line {
+			return e[i].Line < e[j].Line
+		}
+		return e[i].Col < e[j].Col
+	})
+}
+
+// LoadConfig reads and validates the configuration file, which is YAML
+// if its extension is .yaml or .yml and JSON otherwise.
+// The returned error is ConfigErrors if the file is invalid.
+func LoadConfig(name string) (*Config, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		data, cerr := yamlToJSON(name, data)
+		if cerr != nil {
+			return nil, ConfigErrors{cerr}
+		}
+		return ParseConfig(name, data)
+	}
+	return ParseConfig(name, data)
+}
+
+// ParseConfig parses and validates the configuration in JSON, name is used in errors.
+// It does not open the files or look up the interfaces in the configuration,
+// NewServer and ListenerConfig.Listen do.
+func ParseConfig(name string, data []byte) (*Config, error) {
+	src := &configSource{name: name, data: data, positions: map[string]int{}}
+	if err := src.index(reflect.TypeOf(Config{})); err != nil {
+		return nil, ConfigErrors{err}
+	}
+
+	if len(src.errs) != 0 {
+		src.errs.sort()
+		return nil, src.errs
+	}
+
+	var conf Config
+	if err := json.Unmarshal(data, &conf); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, ConfigErrors{src.errorAt(fieldPath(typeErr.Field), fmt.Errorf("cannot use %s as %s", typeErr.Value, typeErr.Type))}
+		}
+		return nil, ConfigErrors{src.errorAt("", err)}
+	}
+
+	if errs := conf.validate(src); len(errs) != 0 {
+		errs.sort()
+		return nil, errs
+	}
+	return &conf, nil
+}
+
+// validate checks the values of c without side effects.
+func (c *Config) validate(src *configSource) ConfigErrors {
+	var errs ConfigErrors
+	fail := func(path string, format string, args ...interface{}) {
+		errs = append(errs, src.errorAt(path, fmt.Errorf(format, args...)))
+	}
+
+	if len(c.Listeners) == 0 {
+		fail("listeners", "at least one listener is required")
+	}
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		switch l.network() {
+		case "tcp":
+			if l.Address == "" {
+				fail(path, "address is required")
+			} else if _, _, err := net.SplitHostPort(l.Address); err != nil {
+				fail(path+".address", "%v", err)
+			}
+		case "unix":
+			if l.Address == "" {
+				fail(path, "address is required")
+			}
+		default:
+			fail(path+".scheme", "unsupported scheme %q", l.Scheme)
+		}
+		if l.TLS != nil && (l.TLS.CertFile == "" || l.TLS.KeyFile == "") {
+			fail(path+".tls", "cert_file and key_file are required")
+		}
+	}
+	for i, u := range c.Users {
+		if u == "" {
+			fail(fmt.Sprintf("users[%d]", i), "empty user")
+		}
+	}
+	if c.UserDB != nil {
+		if len(c.Users) != 0 {
+			fail("user_db", "users and user_db cannot be used together")
+		}
+		if c.UserDB.File == "" {
+			fail("user_db", "file is required")
+		}
+	}
+	if e := c.ExternalAuth; e != nil {
+		if len(c.Users) != 0 || c.UserDB != nil {
+			fail("external_auth", "external_auth cannot be used with users or user_db")
+		}
+		switch {
+		case (e.Webhook == "") == (len(e.Exec) == 0):
+			fail("external_auth", "exactly one of webhook and exec is required")
+		case e.Webhook != "":
+			if u, err := url.Parse(e.Webhook); err != nil {
+				fail("external_auth.webhook", "%v", err)
+			} else if u.Scheme != "http" && u.Scheme != "https" {
+				fail("external_auth.webhook", "unsupported scheme %q", u.Scheme)
+			}
+		}
+		if e.Timeout < 0 {
+			fail("external_auth.timeout", "must not be negative")
+		}
+		if e.CacheTTL < 0 {
+			fail("external_auth.cache_ttl", "must not be negative")
+		}
+	}
+	for i, cl := range c.Clients {
+		path := fmt.Sprintf("clients[%d]", i)
+		if cl.CIDR != "" {
+			if _, _, err := net.ParseCIDR(cl.CIDR); err != nil {
+				fail(path+".cidr", "%v", err)
+			}
+		}
+		switch cl.Action {
+		case "allow", "deny":
+		default:
+			fail(path+".action", "action must be \"allow\" or \"deny\"")
+		}
+	}
+	if c.Bans != nil {
+		if c.Bans.MaxFailures < 0 {
+			fail("bans.max_failures", "must not be negative")
+		}
+		if c.Bans.FindTime < 0 {
+			fail("bans.find_time", "must not be negative")
+		}
+		if c.Bans.BanTime < 0 {
+			fail("bans.ban_time", "must not be negative")
+		}
+	}
+	for i, class := range c.ResetOnDialFailure {
+		switch socks4.DialFailure(class) {
+		case socks4.DialRefused, socks4.DialTimedOut, socks4.DialUnreachable,
+			socks4.DialDNSFailure, socks4.DialPolicy, socks4.DialOther:
+		default:
+			fail(fmt.Sprintf("reset_on_dial_failure[%d]", i), "unknown dial failure %q", class)
+		}
+	}
+	if c.AdvertiseIP != "" {
+		if ip := net.ParseIP(c.AdvertiseIP); ip == nil || ip.To4() == nil {
+			fail("advertise_ip", "must be an IPv4 address")
+		}
+	}
+	if c.Bind.Ports != "" {
+		if _, err := socks4.ParsePortRange(c.Bind.Ports); err != nil {
+			fail("bind.ports", "%v", err)
+		}
+	}
+	for i, r := range c.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if _, err := r.MatchConfig.build(); err != nil {
+			fail(path, "%v", err)
+		}
+		switch r.Action {
+		case "allow", "deny":
+		default:
+			fail(path+".action", "action must be \"allow\" or \"deny\"")
+		}
+	}
+	for i, r := range c.Rewrites {
+		path := fmt.Sprintf("rewrites[%d]", i)
+		if _, err := r.MatchConfig.build(); err != nil {
+			fail(path, "%v", err)
+		}
+		rule := socks4.RewriteRule{To: r.To}
+		if _, err := rule.Rewrite(&protocol.Addr{IP: net.IPv4zero, Port: 1}); err != nil {
+			fail(path+".to", "%v", err)
+		}
+	}
+	if c.Admin != nil {
+		if host, _, err := net.SplitHostPort(c.Admin.Address); err != nil {
+			fail("admin.address", "%v", err)
+		} else if c.Admin.Token == "" && !isLoopback(host) {
+			fail("admin.address", "must be a loopback address unless token is set")
+		}
+	}
+	if e := c.Events; e != nil {
+		if e.File == "" && e.Webhook == "" {
+			fail("events", "file or webhook is required")
+		}
+		if e.MaxFileSize < 0 {
+			fail("events.max_file_size", "must not be negative")
+		}
+		if e.MaxFiles < 0 {
+			fail("events.max_files", "must not be negative")
+		}
+		if e.KeyFile != "" && e.File == "" {
+			fail("events.key_file", "key_file requires file")
+		}
+		if e.Webhook != "" {
+			if u, err := url.Parse(e.Webhook); err != nil {
+				fail("events.webhook", "%v", err)
+			} else if u.Scheme != "http" && u.Scheme != "https" {
+				fail("events.webhook", "unsupported scheme %q", u.Scheme)
+			}
+		}
+	}
+	for i, u := range c.Upstreams {
+		if _, err := socks4.NewDialer(u); err != nil {
+			fail(fmt.Sprintf("upstreams[%d]", i), "%v", err)
+		}
+	}
+	return errs
+}
+
+// isLoopback reports whether host only listens on the loopback interface.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// fieldPath converts a field of json.UnmarshalTypeError such as
+// "listeners.0.address" to a path such as "listeners[0].address".
+func fieldPath(field string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if i != 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+func (m *MatchConfig) build() (socks4.DestinationMatch, error) {
+	match := socks4.DestinationMatch{
+		Host: m.Host,
+		Port: m.Port,
+	}
+	if m.Port < 0 || m.Port > 0xffff {
+		return match, fmt.Errorf("port number out of range %d", m.Port)
+	}
+	if m.CIDR != "" {
+		_, network, err := net.ParseCIDR(m.CIDR)
+		if err != nil {
+			return match, err
+		}
+		match.Network = network
+	}
+	return match, nil
+}
+
+func (t *TLSConfig) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", t.ClientCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// upstream returns the dial function through the upstream proxies.
+func (c *Config) upstream() (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	for _, u := range c.Upstreams {
+		d, err := socks4.NewDialer(u)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", redact(u), err)
+		}
+		d.ProxyDial = dial
+		dial = d.DialContext
+	}
+	return dial, nil
+}
+
+// redact removes the user information from a proxy URL for messages.
+func redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// NewServer returns a server configured by c,
+// stop releases what the server uses once it is replaced.
+func (c *Config) NewServer(logger *log.Logger) (svc *socks4.Server, stop func(), err error) {
+	svc = socks4.NewServer()
+	svc.Logger = logger
+	svc.HandshakeTimeout = time.Duration(c.Timeouts.Handshake)
+	svc.IdleTimeout = time.Duration(c.Timeouts.Idle)
+	svc.DialTimeout = time.Duration(c.Timeouts.Dial)
+	for _, class := range c.ResetOnDialFailure {
+		svc.ResetOnDialFailure = append(svc.ResetOnDialFailure, socks4.DialFailure(class))
+	}
+	svc.ListenBindAcceptTimeout = time.Duration(c.Timeouts.BindAccept)
+	svc.StrictBind = c.Bind.Strict
+	svc.BindWaitForPeer = c.Bind.WaitForPeer
+	if c.Bind.Interface != "" {
+		svc.BindIP, err = c.Bind.bindIP()
+		if err != nil {
+			return nil, nil, fmt.Errorf("bind.interface: %w", err)
+		}
+	}
+	if c.Bind.Ports != "" {
+		ports, err := socks4.ParsePortRange(c.Bind.Ports)
+		if err != nil {
+			return nil, nil, err
+		}
+		svc.BindPorts = &ports
+	}
+	if c.AdvertiseIP != "" {
+		svc.AdvertiseIP = net.ParseIP(c.AdvertiseIP).To4()
+	}
+	if c.Timeouts.BindReuse != nil {
+		svc.ListenBindReuseTimeout = time.Duration(*c.Timeouts.BindReuse)
+	}
+
+	stop = func() {}
+	if c.UserDB != nil {
+		db, err := socks4.LoadUserDB(c.UserDB.File)
+		if err != nil {
+			return nil, nil, fmt.Errorf("user_db.file: %w", err)
+		}
+		interval := time.Duration(c.UserDB.WatchInterval)
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go db.Watch(ctx, interval, logger)
+		svc.Authentication = db
+		stop = cancel
+	} else if e := c.ExternalAuth; e != nil {
+		if e.Webhook != "" {
+			svc.Authentication = &socks4.WebhookAuth{
+				URL:      e.Webhook,
+				Timeout:  time.Duration(e.Timeout),
+				CacheTTL: time.Duration(e.CacheTTL),
+				FailOpen: e.FailOpen,
+				Logger:   logger,
+			}
+		} else {
+			svc.Authentication = &socks4.ExecAuth{
+				Path:     e.Exec[0],
+				Args:     e.Exec[1:],
+				Timeout:  time.Duration(e.Timeout),
+				CacheTTL: time.Duration(e.CacheTTL),
+				FailOpen: e.FailOpen,
+				Logger:   logger,
+			}
+		}
+	} else if len(c.Users) != 0 {
+		users := map[string]struct{}{}
+		for _, u := range c.Users {
+			users[u] = struct{}{}
+		}
+		svc.Authentication = socks4.AuthenticationFunc(func(cmd socks4.Command, username string) bool {
+			_, ok := users[username]
+			return ok
+		})
+	}
+
+	for _, cl := range c.Clients {
+		rule := socks4.ClientRule{Deny: cl.Action == "deny"}
+		if cl.CIDR != "" {
+			_, network, err := net.ParseCIDR(cl.CIDR)
+			if err != nil {
+				stop()
+				return nil, nil, err
+			}
+			rule.Network = network
+		}
+		svc.ClientRules = append(svc.ClientRules, rule)
+	}
+	if c.Bans != nil {
+		svc.Bans = &socks4.BanList{
+			MaxFailures: c.Bans.MaxFailures,
+			FindTime:    time.Duration(c.Bans.FindTime),
+			BanTime:     time.Duration(c.Bans.BanTime),
+		}
+	}
+	for _, r := range c.Rules {
+		match, err := r.MatchConfig.build()
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		svc.Rules = append(svc.Rules, socks4.Rule{DestinationMatch: match, Deny: r.Action == "deny"})
+	}
+	for _, r := range c.Rewrites {
+		match, err := r.MatchConfig.build()
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		svc.Rewrites = append(svc.Rewrites, socks4.RewriteRule{DestinationMatch: match, To: r.To})
+	}
+
+	dial, err := c.upstream()
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	svc.ProxyDial = dial
+	return svc, stop, nil
+}
+
+// NewLogger returns the logger configured by c.
+func (c *Config) NewLogger() (*log.Logger, io.Closer, error) {
+	prefix := "[socks4] "
+	if c.Log.Prefix != nil {
+		prefix = *c.Log.Prefix
+	}
+	if c.Log.File == "" {
+		return log.New(os.Stderr, prefix, log.LstdFlags), io.NopCloser(nil), nil
+	}
+	f, err := os.OpenFile(c.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return log.New(f, prefix, log.LstdFlags), f, nil
+}
+
+// NewEventSink returns the sink of the audit events, which is nil if
+// they are disabled, and what closes it.
+func (c *Config) NewEventSink(logger *log.Logger) (socks4.EventSink, io.Closer, error) {
+	e := c.Events
+	if e == nil {
+		return nil, io.NopCloser(nil), nil
+	}
+	var sinks eventSinks
+	if e.File != "" {
+		var key []byte
+		if e.KeyFile != "" {
+			data, err := os.ReadFile(e.KeyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("events.key_file: %w", err)
+			}
+			key = bytes.TrimSpace(data)
+			if len(key) == 0 {
+				return nil, nil, fmt.Errorf("events.key_file: %s is empty", e.KeyFile)
+			}
+		}
+		sinks = append(sinks, &socks4.EventLog{
+			Path:        e.File,
+			Key:         key,
+			MaxFileSize: e.MaxFileSize,
+			MaxFiles:    e.MaxFiles,
+		})
+	}
+	if e.Webhook != "" {
+		sinks = append(sinks, &socks4.EventWebhook{
+			URL:    e.Webhook,
+			Logger: logger,
+		})
+	}
+	return sinks, sinks, nil
+}
+
+// eventSinks emits every event to each sink.
+type eventSinks []socks4.EventSink
+
+func (e eventSinks) Emit(ev *socks4.Event) error {
+	var errs []string
+	for _, sink := range e {
+		if err := sink.Emit(ev); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (e eventSinks) Close() error {
+	var err error
+	for _, sink := range e {
+		if c, ok := sink.(io.Closer); ok {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// Listen opens the listener configured by l.
+func (l *ListenerConfig) Listen(ctx context.Context) (net.Listener, error) {
+	var conf *tls.Config
+	if l.TLS != nil {
+		var err error
+		conf, err = l.TLS.load()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.Address, err)
+		}
+	}
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, l.network(), l.Address)
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		listener = tls.NewListener(listener, conf)
+	}
+	return listener, nil
+}
+
+// configSource locates paths such as "listeners[0].address" in the file.
+type configSource struct {
+	name      string
+	data      []byte
+	dec       *json.Decoder
+	positions map[string]int
+	// errs are the values that cannot be decoded into their fields
+	errs ConfigErrors
+}
+
+// errorAt returns err located at the value of path,
+// or at the closest parent of path that is in the file.
+func (s *configSource) errorAt(path string, err error) *ConfigError {
+	e := &ConfigError{File: s.name, Path: path, Err: err}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		e.Line, e.Col = s.lineCol(int(syntaxErr.Offset))
+		return e
+	}
+	for p := path; ; {
+		if offset, ok := s.positions[p]; ok {
+			e.Line, e.Col = s.lineCol(offset)
+			return e
+		}
+		i := strings.LastIndexAny(p, ".[")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	return e
+}
+
+func (s *configSource) lineCol(offset int) (int, int) {
+	if offset > len(s.data) {
+		offset = len(s.data)
+	}
+	before := s.data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := offset - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// index records the position of every value and reports unknown fields.
+// Values that cannot be decoded into their fields are collected in errs.
+func (s *configSource) index(t reflect.Type) *ConfigError {
+	s.dec = json.NewDecoder(bytes.NewReader(s.data))
+	s.dec.UseNumber()
+	if err := s.value("", t); err != nil {
+		return err
+	}
+	if _, err := s.dec.Token(); err != io.EOF {
+		return s.errorAt("", errors.New("unexpected data after the top-level value"))
+	}
+	return nil
+}
+
+// next returns the offset of the next token.
+func (s *configSource) next() int {
+	offset := int(s.dec.InputOffset())
+	for offset < len(s.data) {
+		switch s.data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+			continue
+		}
+		break
+	}
+	return offset
+}
+
+func (s *configSource) value(path string, t reflect.Type) *ConfigError {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	start := s.next()
+	s.positions[path] = start
+	tok, err := s.dec.Token()
+	if err != nil {
+		return s.errorAt(path, err)
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		s.check(path, t, start, tok)
+		return nil
+	}
+	if t != nil && !acceptsDelim(t, delim) {
+		what := "object"
+		if delim == '[' {
+			what = "array"
+		}
+		s.errs = append(s.errs, s.errorAt(path, fmt.Errorf("cannot use %s as %s", what, t)))
+		t = nil
+	}
+	switch delim {
+	case '{':
+		for s.dec.More() {
+			offset := s.next()
+			tok, err := s.dec.Token()
+			if err != nil {
+				return s.errorAt(path, err)
+			}
+			key := tok.(string)
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			ft, known := fieldType(t, key)
+			if !known {
+				s.positions[child] = offset
+				return s.errorAt(child, fmt.Errorf("unknown field %q%s", key, suggest(t)))
+			}
+			if err := s.value(child, ft); err != nil {
+				return err
+			}
+		}
+	case '[':
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for i := 0; s.dec.More(); i++ {
+			if err := s.value(path+"["+strconv.Itoa(i)+"]", elem); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := s.dec.Token(); err != nil {
+		return s.errorAt(path, err)
+	}
+	return nil
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// check records an error if the scalar tok at path cannot be decoded into t,
+// including the errors of types with their own UnmarshalJSON.
+func (s *configSource) check(path string, t reflect.Type, start int, tok json.Token) {
+	if t == nil || tok == nil {
+		return
+	}
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		raw := s.data[start:s.dec.InputOffset()]
+		if err := reflect.New(t).Interface().(json.Unmarshaler).UnmarshalJSON(raw); err != nil {
+			s.errs = append(s.errs, s.errorAt(path, err))
+		}
+		return
+	}
+	var value string
+	ok := false
+	switch v := tok.(type) {
+	case string:
+		value = "string"
+		ok = t.Kind() == reflect.String
+	case bool:
+		value = "bool"
+		ok = t.Kind() == reflect.Bool
+	case json.Number:
+		value = "number " + v.String()
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			_, err := strconv.ParseInt(v.String(), 10, t.Bits())
+			ok = err == nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			_, err := strconv.ParseUint(v.String(), 10, t.Bits())
+			ok = err == nil
+		case reflect.Float32, reflect.Float64:
+			ok = true
+		}
+	}
+	if t.Kind() == reflect.Interface {
+		ok = true
+	}
+	if !ok {
+		s.errs = append(s.errs, s.errorAt(path, fmt.Errorf("cannot use %s as %s", value, t)))
+	}
+}
+
+// acceptsDelim reports whether an object or array can be decoded into t.
+func acceptsDelim(t reflect.Type, delim json.Delim) bool {
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Struct, reflect.Map:
+		return delim == '{'
+	case reflect.Slice, reflect.Array:
+		return delim == '['
+	}
+	return false
+}
+
+// fieldType returns the type of the JSON field key of t.
+// Fields of types that are not structs are not checked.
+func fieldType(t reflect.Type, key string) (reflect.Type, bool) {
+	if t == nil {
+		return nil, true
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem(), true
+	case reflect.Struct:
+	default:
+		return nil, true
+	}
+	for _, f := range jsonFields(t) {
+		if strings.EqualFold(f.name, key) {
+			return f.typ, true
+		}
+	}
+	return nil, false
+}
+
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// jsonFields returns the JSON fields of a struct, including embedded ones.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(f.Type)...)
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{name: name, typ: f.Type})
+	}
+	return fields
+}
+
+func suggest(t reflect.Type) string {
+	fields := jsonFields(t)
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		names = append(names, f.name)
+	}
+	sort.Strings(names)
+	return ", expected one of " + strings.Join(names, ", ")
+}
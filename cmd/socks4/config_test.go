@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []ConfigError
+	}{
+		{
+			name: "syntax",
+			data: "{\n  \"listeners\": [}\n",
+			want: []ConfigError{{Line: 2, Path: "listeners"}},
+		},
+		{
+			name: "unknown field",
+			data: "{\n  \"listeners\": [{\"address\": \":1080\", \"adress\": \"\"}]\n}",
+			want: []ConfigError{{Line: 2, Path: "listeners[0].adress"}},
+		},
+		{
+			name: "types",
+			data: "{\n  \"listeners\": [{\"address\": \":1080\"}],\n  \"timeouts\": {\"idle\": 5, \"dial\": \"x\"},\n  \"bans\": {\"max_failures\": \"3\"}\n}",
+			want: []ConfigError{
+				{Line: 3, Path: "timeouts.idle"},
+				{Line: 3, Path: "timeouts.dial"},
+				{Line: 4, Path: "bans.max_failures"},
+			},
+		},
+		{
+			name: "validation sorted",
+			data: "{\n  \"rules\": [{\"action\": \"x\"}],\n  \"users\": [\"\"],\n  \"listeners\": [{\"address\": \"bad\"}]\n}",
+			want: []ConfigError{
+				{Line: 2, Path: "rules[0].action"},
+				{Line: 3, Path: "users[0]"},
+				{Line: 4, Path: "listeners[0].address"},
+			},
+		},
+		{
+			name: "scheme",
+			data: "{\n  \"listeners\": [{\"address\": \":1080\", \"scheme\": \"udp\"}]\n}",
+			want: []ConfigError{{Line: 2, Path: "listeners[0].scheme"}},
+		},
+		{
+			name: "admin",
+			data: "{\n  \"listeners\": [{\"address\": \":1080\"}],\n  \"admin\": {\"address\": \":9090\"}\n}",
+			want: []ConfigError{{Line: 3, Path: "admin.address"}},
+		},
+		{
+			name: "missing",
+			data: "{}",
+			want: []ConfigError{{Line: 0, Path: "listeners"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig("test.json", []byte(tt.data))
+			var errs ConfigErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("got %v, want ConfigErrors", err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(tt.want), errs)
+			}
+			for i, want := range tt.want {
+				if errs[i].Line != want.Line || errs[i].Path != want.Path {
+					t.Errorf("error %d is %v, want line %d at %s", i, errs[i], want.Line, want.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	conf, err := ParseConfig("test.json", []byte(`{
+		"listeners": [{"address": "127.0.0.1:1080"}],
+		"users": ["alice"],
+		"timeouts": {"idle": "5m"},
+		"bind": {"ports": "40000-40100"},
+		"advertise_ip": "203.0.113.7"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, stop, err := conf.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if svc.IdleTimeout.Minutes() != 5 || svc.BindPorts == nil || svc.BindPorts.First != 40000 || svc.AdvertiseIP.String() != "203.0.113.7" {
+		t.Errorf("got server %+v", svc)
+	}
+}
+
+func TestParseConfigNoSideEffects(t *testing.T) {
+	dir := t.TempDir()
+	conf, err := ParseConfig("test.json", []byte(`{
+		"listeners": [{"address": ":1080", "tls": {"cert_file": "missing.pem", "key_file": "missing.pem"}}],
+		"user_db": {"file": "`+filepath.Join(dir, "missing.json")+`"},
+		"bind": {"interface": "no-such-interface"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conf.NewServer(nil); err == nil {
+		t.Error("NewServer succeeded without the user database")
+	}
+	if _, err := conf.Listeners[0].Listen(context.Background()); err == nil {
+		t.Error("Listen succeeded without the certificate")
+	}
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "config.yaml")
+	os.WriteFile(name, []byte(`# socks4
+listeners:
+  - address: ":1080"
+  - address: `+filepath.Join(dir, "socks4.sock")+`
+    scheme: unix
+users: [alice, "bob # not a comment"]
+rules:
+- {cidr: 10.0.0.0/8, action: deny}
+- host: 'it''s.example'
+  port: 443
+  action: allow   # trailing comment
+timeouts:
+  idle: 5m
+bind:
+  strict: true
+upstreams:
+  - socks4a://upstream:1080
+`), 0o600)
+	got, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ParseConfig("config.json", []byte(`{
+		"listeners": [{"address": ":1080"}, {"address": "`+filepath.Join(dir, "socks4.sock")+`", "scheme": "unix"}],
+		"users": ["alice", "bob # not a comment"],
+		"rules": [{"cidr": "10.0.0.0/8", "action": "deny"}, {"host": "it's.example", "port": 443, "action": "allow"}],
+		"timeouts": {"idle": "5m"},
+		"bind": {"strict": true},
+		"upstreams": ["socks4a://upstream:1080"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	l, err := got.Listeners[1].Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	for _, tt := range []struct {
+		data string
+		line int
+	}{
+		{"listeners:\n  - address: \":1080\"\ntimeouts:\n  idle: 5\n", 4},
+		{"listeners:\n  - address: \":1080\"\n   scheme: unix\n", 3},
+		{"listeners: [{address: \":1080\"}\n", 1},
+		{"users: &users [alice]\n", 1},
+	} {
+		os.WriteFile(name, []byte(tt.data), 0o600)
+		_, err := LoadConfig(name)
+		var errs ConfigErrors
+		if !errors.As(err, &errs) || errs[0].Line != tt.line {
+			t.Errorf("LoadConfig(%q) = %v, want an error at line %d", tt.data, err, tt.line)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(valid, []byte(`{"listeners": [{"address": ":1080"}]}`), 0o600)
+	os.WriteFile(invalid, []byte(`{"listeners": []}`), 0o600)
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{valid}, 0},
+		{[]string{"-c", valid}, 0},
+		{[]string{valid, invalid}, 1},
+		{[]string{filepath.Join(dir, "missing.json")}, 1},
+		{nil, 2},
+	}
+	for _, tt := range tests {
+		if got := validate(tt.args); got != tt.want {
+			t.Errorf("validate(%q) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
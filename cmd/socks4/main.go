@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 
 	"github.com/wzshiming/socks4"
@@ -10,14 +14,33 @@ import (
 
 var address string
 var username string
+var config string
 
 func init() {
 	flag.StringVar(&address, "a", ":1080", "listen on the address")
 	flag.StringVar(&username, "u", "", "username")
-	flag.Parse()
+	flag.StringVar(&config, "c", "", "config file, overrides the other flags")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  %s [flags]\n  %s validate <config file>\n\nFlags:\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+	flag.Parse()
+
+	if config != "" {
+		err := runConfig(config)
+		if err != nil {
+			log.New(os.Stderr, "[socks4] ", log.LstdFlags).Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger := log.New(os.Stderr, "[socks4] ", log.LstdFlags)
 	svc := &socks4.Server{
 		Logger: logger,
@@ -30,3 +53,83 @@ func main() {
 		logger.Println(err)
 	}
 }
+
+// validate checks the config files and reports every error with its location.
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	file := fs.String("c", "", "config file")
+	fs.Parse(args)
+	files := fs.Args()
+	if *file != "" {
+		files = append(files, *file)
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "validate: no config file")
+		return 2
+	}
+
+	code := 0
+	for _, name := range files {
+		_, err := LoadConfig(name)
+		if err != nil {
+			var errs ConfigErrors
+			if !errors.As(err, &errs) {
+				err = fmt.Errorf("%s: %w", name, err)
+			}
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s: ok\n", name)
+	}
+	return code
+}
+
+func runConfig(name string) error {
+	conf, err := LoadConfig(name)
+	if err != nil {
+		return err
+	}
+	logger, closer, err := conf.NewLogger()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	events, closeEvents, err := conf.NewEventSink(logger)
+	if err != nil {
+		return err
+	}
+	defer closeEvents.Close()
+
+	r, err := newReloader(name, conf, logger, events)
+	if err != nil {
+		return err
+	}
+	go r.watchSignal()
+
+	ctx := context.Background()
+	errCh := make(chan error, len(conf.Listeners)+1)
+	for _, lc := range conf.Listeners {
+		l, err := lc.Listen(ctx)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		logger.Println("listen on", l.Addr())
+		go func() {
+			errCh <- r.Serve(l)
+		}()
+	}
+	if conf.Admin != nil {
+		admin := &http.Server{
+			Addr:    conf.Admin.Address,
+			Handler: r.adminHandler(conf.Admin.Token),
+		}
+		logger.Println("admin listen on", conf.Admin.Address)
+		go func() {
+			errCh <- admin.ListenAndServe()
+		}()
+	}
+	return <-errCh
+}
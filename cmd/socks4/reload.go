@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wzshiming/socks4"
+)
+
+// reloader serves with the server of the latest valid configuration.
+// Sessions keep the server they started with, so a reload does not drop them.
+type reloader struct {
+	name   string
+	logger *log.Logger
+	mut    sync.Mutex
+	conf   *Config
+	events socks4.EventSink
+	svc    atomic.Value
+	stop   func()
+	// retired are the replaced servers, kept while they have sessions
+	retired []*socks4.Server
+	// failures are the dial failures of the replaced servers
+	failures map[socks4.DialFailure]int64
+}
+
+func newReloader(name string, conf *Config, logger *log.Logger, events socks4.EventSink) (*reloader, error) {
+	r := &reloader{
+		name:   name,
+		logger: logger,
+		conf:   conf,
+		events: events,
+	}
+	svc, stop, err := conf.NewServer(logger)
+	if err != nil {
+		return nil, err
+	}
+	svc.Events = events
+	r.svc.Store(svc)
+	r.stop = stop
+	return r, nil
+}
+
+func (r *reloader) server() *socks4.Server {
+	return r.svc.Load().(*socks4.Server)
+}
+
+// Reload loads the configuration file again. New handshakes use the new users,
+// rules and limits. An invalid file leaves the current configuration in place.
+func (r *reloader) Reload() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	conf, err := LoadConfig(r.name)
+	if err != nil {
+		r.logger.Printf("reload %s failed, keeping the current configuration:\n%v", r.name, err)
+		return err
+	}
+	svc, stop, err := conf.NewServer(r.logger)
+	if err != nil {
+		r.logger.Printf("reload %s failed, keeping the current configuration: %v", r.name, err)
+		return err
+	}
+	svc.Events = r.events
+	if !reflect.DeepEqual(conf.Listeners, r.conf.Listeners) ||
+		!reflect.DeepEqual(conf.Log, r.conf.Log) ||
+		!reflect.DeepEqual(conf.Admin, r.conf.Admin) ||
+		!reflect.DeepEqual(conf.Events, r.conf.Events) {
+		r.logger.Println("listeners, log, admin and events changes take effect after a restart")
+	}
+	if old := r.server().Bans; old != nil && svc.Bans != nil {
+		for _, b := range old.Bans() {
+			svc.Bans.Ban(b.IP, b.Until)
+		}
+	}
+	r.conf = conf
+	r.retireStats(r.server())
+	r.pruneRetired()
+	r.retired = append(r.retired, r.server())
+	r.svc.Store(svc)
+	r.stop()
+	r.stop = stop
+	r.logger.Println("reloaded", r.name)
+	return nil
+}
+
+// servers returns the current server and the replaced ones with sessions.
+func (r *reloader) servers() []*socks4.Server {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.pruneRetired()
+	return append([]*socks4.Server{r.server()}, r.retired...)
+}
+
+// pruneRetired drops the replaced servers without sessions, r.mut is held.
+func (r *reloader) pruneRetired() {
+	retired := r.retired[:0]
+	for _, svc := range r.retired {
+		if len(svc.Sessions()) != 0 {
+			retired = append(retired, svc)
+		}
+	}
+	for i := len(retired); i != len(r.retired); i++ {
+		r.retired[i] = nil
+	}
+	r.retired = retired
+}
+
+// retireStats keeps the counters of a replaced server. Failures of its
+// sessions that were still dialing when it was replaced are not counted.
+func (r *reloader) retireStats(svc *socks4.Server) {
+	if r.failures == nil {
+		r.failures = map[socks4.DialFailure]int64{}
+	}
+	for class, n := range svc.DialFailures() {
+		r.failures[class] += n
+	}
+}
+
+// dialFailures returns the dial failures since the start.
+func (r *reloader) dialFailures() map[socks4.DialFailure]int64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	failures := map[socks4.DialFailure]int64{}
+	for class, n := range r.failures {
+		failures[class] = n
+	}
+	for class, n := range r.server().DialFailures() {
+		failures[class] += n
+	}
+	return failures
+}
+
+// Serve accepts connections on l and serves each with the current server.
+func (r *reloader) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.server().ServeConn(conn)
+	}
+}
+
+// adminHandler returns the handler of the admin endpoint. Every path but
+// /health requires the bearer token if it is not empty.
+func (r *reloader) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.Reload(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(rw, "ok")
+	})
+	mux.HandleFunc("/health", func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "ok")
+	})
+	mux.HandleFunc("/stats", func(rw http.ResponseWriter, req *http.Request) {
+		stats := statsJSON{DialFailures: map[socks4.DialFailure]int64{}}
+		for _, svc := range r.servers() {
+			stats.Sessions += len(svc.Sessions())
+		}
+		for class, n := range r.dialFailures() {
+			stats.DialFailures[class] = n
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(stats)
+	})
+	mux.HandleFunc("/sessions", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			list := []sessionJSON{}
+			for _, svc := range r.servers() {
+				for _, info := range svc.Sessions() {
+					list = append(list, newSessionJSON(info))
+				}
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(list)
+		case http.MethodDelete:
+			id := req.URL.Query().Get("id")
+			for _, svc := range r.servers() {
+				if svc.CancelSession(id) {
+					fmt.Fprintln(rw, "ok")
+					return
+				}
+			}
+			http.Error(rw, "no such session", http.StatusNotFound)
+		default:
+			rw.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/bans", func(rw http.ResponseWriter, req *http.Request) {
+		bans := r.server().Bans
+		if bans == nil {
+			http.Error(rw, "bans are disabled", http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			list := []banJSON{}
+			for _, b := range bans.Bans() {
+				list = append(list, banJSON{IP: b.IP.String(), Until: b.Until})
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(list)
+		case http.MethodDelete:
+			ip := net.ParseIP(req.URL.Query().Get("ip"))
+			if ip == nil {
+				http.Error(rw, "invalid ip", http.StatusBadRequest)
+				return
+			}
+			if !bans.Lift(ip) {
+				http.Error(rw, "not banned", http.StatusNotFound)
+				return
+			}
+			fmt.Fprintln(rw, "ok")
+		default:
+			rw.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	if token == "" {
+		return mux
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(rw, req)
+	})
+}
+
+type statsJSON struct {
+	Sessions     int                          `json:"sessions"`
+	DialFailures map[socks4.DialFailure]int64 `json:"dial_failures"`
+}
+
+type sessionJSON struct {
+	ID          string    `json:"id"`
+	Client      string    `json:"client"`
+	Username    string    `json:"username,omitempty"`
+	Command     string    `json:"command,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	SniffedHost string    `json:"sniffed_host,omitempty"`
+	Start       time.Time `json:"start"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+}
+
+func newSessionJSON(info socks4.SessionInfo) sessionJSON {
+	s := sessionJSON{
+		ID:          info.ID,
+		Username:    info.Username,
+		Destination: info.Destination,
+		SniffedHost: info.SniffedHost,
+		Start:       info.Start,
+		BytesIn:     info.BytesIn,
+		BytesOut:    info.BytesOut,
+	}
+	if info.Client != nil {
+		s.Client = info.Client.String()
+	}
+	switch info.Command {
+	case socks4.ConnectCommand:
+		s.Command = "connect"
+	case socks4.BindCommand:
+		s.Command = "bind"
+	}
+	return s
+}
+
+type banJSON struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wzshiming/socks4"
+)
+
+func TestAdminHandler(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(data string) {
+		if err := os.WriteFile(name, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"listeners": [{"address": "127.0.0.1:0"}], "users": ["alice"], "bans": {}}`)
+	conf, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newReloader(name, conf, log.New(io.Discard, "", 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go r.Serve(listen)
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	admin := httptest.NewServer(r.adminHandler("secret"))
+	defer admin.Close()
+	token := "secret"
+	do := func(method, path string, want int, v interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(method, admin.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: got status %d, want %d", method, path, resp.StatusCode, want)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	dial, err := socks4.NewDialer("socks4://alice@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	token = "wrong"
+	do(http.MethodGet, "/stats", http.StatusUnauthorized, nil)
+	do(http.MethodGet, "/health", http.StatusOK, nil)
+	token = "secret"
+
+	var stats statsJSON
+	do(http.MethodGet, "/stats", http.StatusOK, &stats)
+	if stats.Sessions != 1 {
+		t.Errorf("got %d sessions in stats, want 1", stats.Sessions)
+	}
+	var sessions []sessionJSON
+	do(http.MethodGet, "/sessions", http.StatusOK, &sessions)
+	if len(sessions) != 1 || sessions[0].Username != "alice" || sessions[0].Command != "connect" {
+		t.Fatalf("got sessions %+v", sessions)
+	}
+
+	// A reload keeps the session on the replaced server.
+	writeConfig(`{"listeners": [{"address": "127.0.0.1:0"}], "users": ["alice", "bob"], "bans": {}}`)
+	do(http.MethodPost, "/reload", http.StatusOK, nil)
+	if len(r.conf.Users) != 2 {
+		t.Errorf("got users %q after reload", r.conf.Users)
+	}
+	writeConfig(`{"listeners": []}`)
+	do(http.MethodPost, "/reload", http.StatusBadRequest, nil)
+	do(http.MethodGet, "/reload", http.StatusMethodNotAllowed, nil)
+
+	do(http.MethodDelete, "/sessions?id="+sessions[0].ID, http.StatusOK, nil)
+	do(http.MethodDelete, "/sessions?id="+sessions[0].ID, http.StatusNotFound, nil)
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("killed session still open")
+	}
+
+	r.server().Bans.Ban(net.IPv4(192, 0, 2, 1), time.Now().Add(time.Hour))
+	var bans []banJSON
+	do(http.MethodGet, "/bans", http.StatusOK, &bans)
+	if len(bans) != 1 || bans[0].IP != "192.0.2.1" {
+		t.Fatalf("got bans %+v", bans)
+	}
+	do(http.MethodDelete, "/bans?ip=192.0.2.1", http.StatusOK, nil)
+	do(http.MethodDelete, "/bans?ip=192.0.2.1", http.StatusNotFound, nil)
+	do(http.MethodDelete, "/bans?ip=bad", http.StatusBadRequest, nil)
+}
+
+func TestReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(data string) {
+		if err := os.WriteFile(name, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"listeners": [{"address": "127.0.0.1:0"}], "users": ["alice"]}`)
+	conf, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	r, err := newReloader(name, conf, log.New(&logs, "", 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go r.Serve(listen)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	echo := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(conn, buf)
+		return err
+	}
+
+	alice, err := socks4.NewDialer("socks4://alice@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := alice.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// An invalid file keeps the current configuration and logs why.
+	writeConfig(`{"listeners": [{"address": "127.0.0.1:0"}], "users": [""]}`)
+	svc := r.server()
+	if err := r.Reload(); err == nil {
+		t.Fatal("reloaded an invalid file")
+	}
+	if r.server() != svc || len(r.conf.Users) != 1 {
+		t.Error("an invalid file replaced the configuration")
+	}
+	if !strings.Contains(logs.String(), "keeping the current configuration") || !strings.Contains(logs.String(), "users[0]: empty user") {
+		t.Errorf("got log %q", logs.String())
+	}
+
+	// A valid file replaces the users, the live session stays up.
+	writeConfig(`{"listeners": [{"address": "127.0.0.1:0"}], "users": ["bob"]}`)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(conn); err != nil {
+		t.Errorf("session after reload: %v", err)
+	}
+	if n := len(r.servers()); n != 2 {
+		t.Errorf("got %d servers, want the current one and the one with the session", n)
+	}
+	if _, err := alice.Dial("tcp", target.Addr().String()); err == nil {
+		t.Error("removed user connected after reload")
+	}
+	bob, err := socks4.NewDialer("socks4://bob@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := bob.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if err := echo(conn2); err != nil {
+		t.Error(err)
+	}
+
+	// The replaced server is dropped by the next reload once its last session ends.
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	r.mut.Lock()
+	n := len(r.retired)
+	r.mut.Unlock()
+	if n != 1 {
+		t.Errorf("got %d retired servers, want 1", n)
+	}
+}
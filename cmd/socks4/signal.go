@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchSignal reloads on SIGHUP.
+func (r *reloader) watchSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		r.Reload()
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// watchSignal does nothing, there is no SIGHUP on this platform,
+// use the reload admin endpoint instead.
+func (r *reloader) watchSignal() {}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// yamlToJSON converts a configuration file in YAML to JSON. It supports the
+// block mappings and sequences, flow collections, quoted and plain scalars
+// and comments a configuration needs, not anchors, tags or multi-line strings.
+// Every value keeps its line, so errors in the JSON are located in the YAML.
+func yamlToJSON(name string, data []byte) ([]byte, *ConfigError) {
+	c := &yamlConverter{name: name, line: 1, col: 1}
+	for i, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimRight(text, "\r")
+		content := strings.TrimLeft(text, " ")
+		indent := len(text) - len(content)
+		content = strings.TrimRight(stripYAMLComment(content), " \t")
+		if content == "" || content == "---" || content == "..." {
+			continue
+		}
+		if content[0] == '\t' {
+			return nil, c.errorf(yamlLine{num: i + 1, indent: indent}, 0, "tabs are not allowed in indentation")
+		}
+		c.lines = append(c.lines, yamlLine{num: i + 1, indent: indent, text: content})
+	}
+	if len(c.lines) == 0 {
+		return []byte("{}"), nil
+	}
+	if err := c.node(c.lines[0].indent); err != nil {
+		return nil, err
+	}
+	if c.i != len(c.lines) {
+		return nil, c.errorf(c.lines[c.i], 0, "unexpected indentation")
+	}
+	return c.out.Bytes(), nil
+}
+
+// yamlLine is a line without indentation and comment.
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlConverter struct {
+	name  string
+	lines []yamlLine
+	i     int
+	out   bytes.Buffer
+	// line and col are the position of the end of out
+	line int
+	col  int
+}
+
+func (c *yamlConverter) errorf(l yamlLine, offset int, format string, args ...interface{}) *ConfigError {
+	return &ConfigError{
+		File: c.name,
+		Line: l.num,
+		Col:  l.indent + offset + 1,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+// emit writes s at the line and column of offset in l, or after the
+// previous value if it is already past them.
+func (c *yamlConverter) emit(l yamlLine, offset int, s string) {
+	for c.line < l.num {
+		c.out.WriteByte('\n')
+		c.line++
+		c.col = 1
+	}
+	for c.col < l.indent+offset+1 {
+		c.out.WriteByte(' ')
+		c.col++
+	}
+	c.write(s)
+}
+
+func (c *yamlConverter) write(s string) {
+	c.out.WriteString(s)
+	c.col += len(s)
+}
+
+// node converts the mapping, sequence or scalar starting at the current line.
+func (c *yamlConverter) node(indent int) *ConfigError {
+	l := c.lines[c.i]
+	switch {
+	case isYAMLSequenceItem(l.text):
+		return c.sequence(indent)
+	case yamlKeyEnd(l.text) >= 0:
+		return c.mapping(indent)
+	}
+	c.i++
+	return c.inline(l, 0)
+}
+
+func (c *yamlConverter) mapping(indent int) *ConfigError {
+	c.emit(c.lines[c.i], 0, "{")
+	for first := true; c.i < len(c.lines); first = false {
+		l := c.lines[c.i]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return c.errorf(l, 0, "unexpected indentation")
+		}
+		end := yamlKeyEnd(l.text)
+		if end < 0 {
+			return c.errorf(l, 0, "expected a key")
+		}
+		key, err := yamlScalar(strings.TrimSpace(l.text[:end]))
+		if err != nil {
+			return c.errorf(l, 0, "%v", err)
+		}
+		if _, ok := key.(string); !ok {
+			key = strings.TrimSpace(l.text[:end])
+		}
+		k, _ := json.Marshal(key)
+		if !first {
+			c.write(",")
+		}
+		c.emit(l, 0, string(k)+":")
+		c.i++
+
+		rest := strings.TrimLeft(l.text[end+1:], " ")
+		if rest != "" {
+			if err := c.inline(l, len(l.text)-len(rest)); err != nil {
+				return err
+			}
+			continue
+		}
+		if c.i < len(c.lines) {
+			next := c.lines[c.i]
+			if next.indent > indent || next.indent == indent && isYAMLSequenceItem(next.text) {
+				if err := c.node(next.indent); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		c.write("null")
+	}
+	c.write("}")
+	return nil
+}
+
+func (c *yamlConverter) sequence(indent int) *ConfigError {
+	c.emit(c.lines[c.i], 0, "[")
+	for first := true; c.i < len(c.lines); first = false {
+		l := &c.lines[c.i]
+		if l.indent < indent || l.indent == indent && !isYAMLSequenceItem(l.text) {
+			break
+		}
+		if l.indent > indent {
+			return c.errorf(*l, 0, "unexpected indentation")
+		}
+		if !first {
+			c.write(",")
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			c.i++
+			if c.i < len(c.lines) && c.lines[c.i].indent > indent {
+				if err := c.node(c.lines[c.i].indent); err != nil {
+					return err
+				}
+				continue
+			}
+			c.emit(*l, 0, "null")
+			continue
+		}
+		// The item is a node starting at its own column, so the following
+		// keys of a mapping in the item line up with its first one.
+		l.indent += len(l.text) - len(rest)
+		l.text = rest
+		if err := c.node(l.indent); err != nil {
+			return err
+		}
+	}
+	c.write("]")
+	return nil
+}
+
+// inline converts the scalar or flow collection at offset in l.
+func (c *yamlConverter) inline(l yamlLine, offset int) *ConfigError {
+	p := &yamlFlow{s: l.text, pos: offset}
+	v, err := p.value(false)
+	if err == nil {
+		p.skipSpace()
+		if p.pos != len(p.s) {
+			err = fmt.Errorf("unexpected %q", p.s[p.pos:])
+		}
+	}
+	if err != nil {
+		return c.errorf(l, p.pos, "%v", err)
+	}
+	data, _ := json.Marshal(v)
+	c.emit(l, offset, string(data))
+	return nil
+}
+
+// yamlFlow parses a scalar or a flow collection such as [a, {b: c}].
+type yamlFlow struct {
+	s   string
+	pos int
+}
+
+func (p *yamlFlow) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *yamlFlow) value(inFlow bool) (interface{}, error) {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return nil, nil
+	}
+	switch p.s[p.pos] {
+	case '[':
+		p.pos++
+		list := []interface{}{}
+		for {
+			p.skipSpace()
+			if p.pos < len(p.s) && p.s[p.pos] == ']' {
+				p.pos++
+				return list, nil
+			}
+			v, err := p.value(true)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			if err := p.next(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		p.pos++
+		m := map[string]interface{}{}
+		for {
+			p.skipSpace()
+			if p.pos < len(p.s) && p.s[p.pos] == '}' {
+				p.pos++
+				return m, nil
+			}
+			k, err := p.value(true)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			p.skipSpace()
+			if p.pos == len(p.s) || p.s[p.pos] != ':' {
+				return nil, errors.New("expected ':' after a key")
+			}
+			p.pos++
+			if m[key], err = p.value(true); err != nil {
+				return nil, err
+			}
+			if err := p.next('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"', '\'':
+		end := quotedEnd(p.s[p.pos:])
+		if end < 0 {
+			return nil, errors.New("unterminated string")
+		}
+		v, err := yamlScalar(p.s[p.pos : p.pos+end])
+		p.pos += end
+		return v, err
+	}
+	end := p.pos
+	for ; inFlow && end < len(p.s); end++ {
+		if c := p.s[end]; c == ',' || c == ']' || c == '}' ||
+			c == ':' && (end+1 == len(p.s) || strings.IndexByte(" ,]}", p.s[end+1]) >= 0) {
+			break
+		}
+	}
+	if !inFlow {
+		end = len(p.s)
+	}
+	v, err := yamlScalar(strings.TrimRight(p.s[p.pos:end], " "))
+	p.pos = end
+	return v, err
+}
+
+// next skips the comma between the items of a collection ending with close.
+func (p *yamlFlow) next(close byte) error {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return fmt.Errorf("expected %q", close)
+	}
+	switch p.s[p.pos] {
+	case ',':
+		p.pos++
+		return nil
+	case close:
+		return nil
+	}
+	return fmt.Errorf("expected ',' or %q", close)
+}
+
+// yamlScalar returns the value of a quoted or plain scalar.
+func yamlScalar(s string) (interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	switch s[0] {
+	case '"':
+		var v string
+		if quotedEnd(s) != len(s) || json.Unmarshal([]byte(s), &v) != nil {
+			return nil, fmt.Errorf("invalid double-quoted string %s", s)
+		}
+		return v, nil
+	case '\'':
+		if quotedEnd(s) != len(s) {
+			return nil, fmt.Errorf("invalid single-quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case '&', '*', '!', '|', '>', '%', '@', '`', '?':
+		return nil, fmt.Errorf("unsupported YAML syntax %q", s)
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if c := s[0]; (c == '-' || c >= '0' && c <= '9') && json.Valid([]byte(s)) {
+		return json.Number(s), nil
+	}
+	return s, nil
+}
+
+// quotedEnd returns the length of the quoted string at the start of s,
+// or -1 if it is not terminated.
+func quotedEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// isYAMLSequenceItem reports whether the line is an item of a block sequence.
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlKeyEnd returns the index of the colon after the key of a mapping
+// entry, or -1 if the line is not one.
+func yamlKeyEnd(text string) int {
+	if text[0] == '[' || text[0] == '{' {
+		return -1
+	}
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			if i == 0 {
+				end := quotedEnd(text)
+				if end < 0 {
+					return -1
+				}
+				i = end - 1
+			}
+		case ':':
+			if i+1 == len(text) || text[i+1] == ' ' {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment removes a comment, which starts with '#' at the start
+// of the line or after a space, outside quoted strings.
+func stripYAMLComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			if i == 0 || strings.IndexByte(" [{,:", text[i-1]) >= 0 {
+				end := quotedEnd(text[i:])
+				if end < 0 {
+					return text
+				}
+				i += end - 1
+			}
+		case '#':
+			if i == 0 || text[i-1] == ' ' || text[i-1] == '\t' {
+				return text[:i]
+			}
+		}
+	}
+	return text
+}
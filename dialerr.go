@@ -0,0 +1,150 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// DialFailure is the class of a failed CONNECT.
+type DialFailure string
+
+const (
+	// DialRefused is a destination that refused the connection.
+	DialRefused DialFailure = "refused"
+	// DialTimedOut is a destination that did not answer in time.
+	DialTimedOut DialFailure = "timeout"
+	// DialUnreachable is a destination without a route.
+	DialUnreachable DialFailure = "unreachable"
+	// DialDNSFailure is a hostname that could not be resolved.
+	DialDNSFailure DialFailure = "dns"
+	// DialPolicy is a destination denied by Rules or a hook.
+	DialPolicy DialFailure = "policy"
+	// DialOther is any other failure.
+	DialOther DialFailure = "other"
+)
+
+// DialError is a failed CONNECT with its class.
+type DialError struct {
+	Class DialFailure
+	Err   error
+}
+
+func (e *DialError) Error() string {
+	return string(e.Class) + ": " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyDialError returns the class of an error dialing a destination.
+func ClassifyDialError(err error) DialFailure {
+	var dialErr *DialError
+	if errors.As(err, &dialErr) {
+		return dialErr.Class
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrDenied):
+		return DialPolicy
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return DialTimedOut
+		}
+		return DialDNSFailure
+	case isConnRefused(err):
+		return DialRefused
+	case isUnreachable(err):
+		return DialUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		isTimedOut(err):
+		return DialTimedOut
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return DialTimedOut
+	}
+	return DialOther
+}
+
+// dialStats counts the failed CONNECTs by class.
+type dialStats struct {
+	mut      sync.Mutex
+	failures map[DialFailure]int64
+}
+
+func (d *dialStats) add(class DialFailure) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.failures == nil {
+		d.failures = map[DialFailure]int64{}
+	}
+	d.failures[class]++
+}
+
+// DialFailures returns the number of failed CONNECTs by class.
+func (s *Server) DialFailures() map[DialFailure]int64 {
+	s.dialStats.mut.Lock()
+	defer s.dialStats.mut.Unlock()
+	failures := make(map[DialFailure]int64, len(s.dialStats.failures))
+	for class, n := range s.dialStats.failures {
+		failures[class] = n
+	}
+	return failures
+}
+
+// resetOn reports whether failures of the class close the client
+// connection with a reset instead of a reply.
+func (s *Server) resetOn(class DialFailure) bool {
+	for _, c := range s.ResetOnDialFailure {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// failDial records a failed CONNECT, then replies to the client or resets
+// the connection, and returns the error of the session.
+func (s *Server) failDial(req *Request, err error) error {
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) {
+		dialErr = &DialError{Class: ClassifyDialError(err), Err: err}
+	}
+	s.recordDialFailure(req, dialErr.Class)
+	if s.resetOn(dialErr.Class) {
+		resetConn(req.Conn)
+		return phaseError(PhaseDial, fmt.Errorf("connect to %v failed, reset: %w", req.destination(), dialErr))
+	}
+	if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+		return phaseError(PhaseDial, fmt.Errorf("failed to send reply: %v", err))
+	}
+	return phaseError(PhaseDial, fmt.Errorf("connect to %v failed: %w", req.destination(), dialErr))
+}
+
+// recordDialFailure counts the failed CONNECT of req by its class.
+func (s *Server) recordDialFailure(req *Request, class DialFailure) {
+	s.dialStats.add(class)
+	req.dialFailure = class
+}
+
+// resetConn makes closing the connection send a TCP RST where supported.
+func resetConn(conn net.Conn) {
+	for conn != nil {
+		switch c := conn.(type) {
+		case interface{ SetLinger(sec int) error }:
+			c.SetLinger(0)
+			return
+		case *bufferedConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !unix && !windows
+
+package socks4
+
+import (
+	"strings"
+)
+
+// These platforms have no portable error numbers, timeouts are still
+// classified by net.Error.
+
+func isConnRefused(err error) bool {
+	return strings.Contains(err.Error(), "connection refused")
+}
+
+func isUnreachable(err error) bool {
+	return strings.Contains(err.Error(), "unreachable")
+}
+
+func isTimedOut(err error) bool {
+	return false
+}
+
+func isAddrInUse(err error) bool {
+	return strings.Contains(err.Error(), "in use")
+}
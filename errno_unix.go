@@ -0,0 +1,24 @@
+//go:build unix
+
+package socks4
+
+import (
+	"errors"
+	"syscall"
+)
+
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+func isTimedOut(err error) bool {
+	return errors.Is(err, syscall.ETIMEDOUT)
+}
+
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package socks4
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Winsock and system error codes, which the syscall package does not define.
+const (
+	wsaeaddrinuse           syscall.Errno = 10048
+	wsaenetunreach          syscall.Errno = 10051
+	wsaetimedout            syscall.Errno = 10060
+	wsaeconnrefused         syscall.Errno = 10061
+	wsaehostunreach         syscall.Errno = 10065
+	errorConnectionRefused  syscall.Errno = 1225
+	errorNetworkUnreachable syscall.Errno = 1231
+	errorHostUnreachable    syscall.Errno = 1232
+)
+
+func isConnRefused(err error) bool {
+	return errors.Is(err, wsaeconnrefused) || errors.Is(err, errorConnectionRefused)
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, wsaehostunreach) || errors.Is(err, wsaenetunreach) ||
+		errors.Is(err, errorHostUnreachable) || errors.Is(err, errorNetworkUnreachable)
+}
+
+func isTimedOut(err error) bool {
+	return errors.Is(err, wsaetimedout)
+}
+
+func isAddrInUse(err error) bool {
+	return errors.Is(err, wsaeaddrinuse)
+}
@@ -0,0 +1,91 @@
+package socks4
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrRequestRejected is matched by a ReplyError with RejectedReply.
+	ErrRequestRejected = errors.New("request rejected or failed")
+	// ErrNoIdentd is matched by a ReplyError with NoIdentdReply.
+	ErrNoIdentd = errors.New("cannot connect to identd on the client")
+	// ErrInvalidUser is matched by a ReplyError with InvalidUserReply.
+	ErrInvalidUser = errors.New("invalid user")
+	// ErrUserAuthFailed is returned by the server when Authentication rejects a request.
+	ErrUserAuthFailed = errors.New("user authentication failed")
+	// ErrIdleTimeout is returned by the server when a tunnel is closed for IdleTimeout.
+	ErrIdleTimeout = errors.New("tunnel idle timeout")
+	// ErrDenied is returned by the server when Rules deny a destination.
+	ErrDenied = errors.New("destination denied by rule")
+	// ErrBindPeerMismatch is returned by the server when the peer of a BIND
+	// does not connect from DSTIP, see Server.StrictBind.
+	ErrBindPeerMismatch = errors.New("bind peer does not match the destination")
+	// ErrNoBindPort is returned by the server when every port of
+	// Server.BindPorts is in use.
+	ErrNoBindPort = errors.New("no free port for bind")
+	// ErrClientDenied is returned by the server when ClientRules deny a client.
+	ErrClientDenied = errors.New("client denied by rule")
+	// ErrClientBanned is returned by the server when a client is banned by Bans.
+	ErrClientBanned = errors.New("client banned")
+)
+
+// ReplyError is returned by the Dialer when the proxy server does not grant a request.
+type ReplyError struct {
+	// Code is the reply code sent by the proxy server
+	Code ReplyCode
+	// Command is the command of the request
+	Command Command
+	// Target is the destination address of the request
+	Target string
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("socks connection request failed: %s %s: %s", e.Command, e.Target, e.Code)
+}
+
+// Is reports whether the reply code corresponds to target.
+func (e *ReplyError) Is(target error) bool {
+	switch target {
+	case ErrRequestRejected:
+		return e.Code == RejectedReply
+	case ErrNoIdentd:
+		return e.Code == NoIdentdReply
+	case ErrInvalidUser:
+		return e.Code == InvalidUserReply
+	}
+	return false
+}
+
+// Phase is the phase of a session on the server in which an error occurred.
+type Phase string
+
+const (
+	PhaseAccept    Phase = "accept"
+	PhaseHandshake Phase = "handshake"
+	PhaseAuth      Phase = "auth"
+	PhaseDial      Phase = "dial"
+	PhaseBind      Phase = "bind"
+	PhaseTunnel    Phase = "tunnel"
+)
+
+// ServerError is returned by the server with the phase in which Err occurred.
+type ServerError struct {
+	Phase Phase
+	Err   error
+}
+
+func (e *ServerError) Error() string {
+	return string(e.Phase) + ": " + e.Err.Error()
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+func phaseError(phase Phase, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ServerError{Phase: phase, Err: err}
+}
@@ -0,0 +1,468 @@
+package socks4
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of an Event.
+type EventType string
+
+const (
+	// EventAccepted is a client connection that passed ClientRules and Bans.
+	EventAccepted EventType = "accepted"
+	// EventAuthenticated is a request that passed Authentication.
+	EventAuthenticated EventType = "authenticated"
+	// EventAuthFailed is a request that Authentication rejected.
+	EventAuthFailed EventType = "auth_failed"
+	// EventDenied is a client or a request denied by rules, bans or quotas.
+	EventDenied EventType = "denied"
+	// EventDialFailed is a CONNECT that could not reach its destination
+	// or a BIND that could not listen.
+	EventDialFailed EventType = "dial_failed"
+	// EventConnected is a CONNECT that reached its destination.
+	EventConnected EventType = "connected"
+	// EventBindOpened is a BIND listener announced to the client.
+	EventBindOpened EventType = "bind_opened"
+	// EventBindAccepted is a peer accepted on a BIND listener.
+	EventBindAccepted EventType = "bind_accepted"
+	// EventClosed is the end of a session.
+	EventClosed EventType = "closed"
+)
+
+// Event is a decision of the server about a session.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Session identifies the session, it is Request.ID
+	Session  string `json:"session"`
+	Client   string `json:"client,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Command is "connect" or "bind"
+	Command     string `json:"command,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// SniffedHost is the TLS SNI or HTTP Host of a CONNECT, once it is sniffed
+	SniffedHost string `json:"sniffed_host,omitempty"`
+	// Addr is the BIND listener of EventBindOpened or the peer of EventBindAccepted
+	Addr string `json:"addr,omitempty"`
+	// Reason is why a session was denied, failed or closed
+	Reason string `json:"reason,omitempty"`
+}
+
+// EventSink receives the events of a server.
+// Emit is called from the goroutines of the sessions and must not block for long.
+type EventSink interface {
+	Emit(ev *Event) error
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// emit sends an event of the session of req to the sink of the server.
+func (s *Server) emit(req *Request, typ EventType, addr string, reason error) {
+	if s.Events == nil {
+		return
+	}
+	ev := &Event{
+		Type:     typ,
+		Time:     time.Now(),
+		Session:  req.ID,
+		Username: req.Username,
+	}
+	if req.Conn != nil && req.Conn.RemoteAddr() != nil {
+		ev.Client = req.Conn.RemoteAddr().String()
+	}
+	if req.DestinationAddr != nil {
+		ev.Command = commandName(req.Command)
+		ev.Destination = req.destination()
+	}
+	ev.SniffedHost = req.SniffedHost
+	ev.Addr = addr
+	if reason != nil {
+		ev.Reason = reason.Error()
+	}
+	if err := s.Events.Emit(ev); err != nil && s.Logger != nil {
+		s.Logger.Println("emit event failed:", err)
+	}
+}
+
+// EventLog is an EventSink that appends events to a JSON Lines file.
+//
+// Every line has a "prev" field with the HMAC-SHA256 by Key of the previous
+// line, continuing across rotated files and restarts, so that removed or
+// modified lines are detected by VerifyEventLog. Lines removed from the end
+// are only detected against a copy of Head kept elsewhere.
+type EventLog struct {
+	// Path is the current file, rotated files are Path with a timestamp suffix
+	Path string
+	// Key is the HMAC key of the chain. Without it the chain is a plain SHA-256,
+	// which anyone who can write the file can recompute
+	Key []byte
+	// MaxFileSize rotates the file once it would exceed this many bytes,
+	// 0 means no limit
+	MaxFileSize int64
+	// MaxFiles removes the oldest rotated files beyond this count,
+	// 0 means no limit
+	MaxFiles int
+
+	mut  sync.Mutex
+	file *os.File
+	size int64
+	prev string
+}
+
+type eventRecord struct {
+	*Event
+	Prev string `json:"prev"`
+}
+
+// Emit appends the event to the file.
+func (l *EventLog) Emit(ev *Event) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(eventRecord{Event: ev, Prev: l.prev})
+	if err != nil {
+		return err
+	}
+	if l.MaxFileSize > 0 && l.size > 0 && l.size+int64(len(line))+1 > l.MaxFileSize {
+		if err := l.rotate(ev.Time); err != nil {
+			return err
+		}
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	l.size += int64(len(line)) + 1
+	l.prev = eventHash(l.Key, line)
+	return nil
+}
+
+// Head returns the hash of the last line written, which the next line
+// follows. Keeping it outside the file detects lines removed from its end.
+func (l *EventLog) Head() string {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.prev
+}
+
+// Close closes the file.
+func (l *EventLog) Close() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// open opens the file for appending and continues the chain from its last line.
+func (l *EventLog) open() error {
+	file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	var last []byte
+	var size int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		size += int64(len(scanner.Bytes())) + 1
+		if len(scanner.Bytes()) != 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = size
+	if last != nil {
+		l.prev = eventHash(l.Key, last)
+	}
+	return nil
+}
+
+func (l *EventLog) rotate(t time.Time) error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	name := l.Path + "." + t.UTC().Format(eventLogSuffix)
+	if err := os.Rename(l.Path, name); err != nil {
+		return err
+	}
+	if l.MaxFiles > 0 {
+		rotated, err := l.rotated()
+		if err == nil && len(rotated) > l.MaxFiles {
+			for _, old := range rotated[:len(rotated)-l.MaxFiles] {
+				os.Remove(old)
+			}
+		}
+	}
+	file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+// eventLogSuffix is the timestamp suffix of rotated files.
+const eventLogSuffix = "20060102T150405.000000000"
+
+// rotated returns the rotated files, oldest first. Only names with the
+// exact timestamp suffix count, not other files such as Path+".bak".
+func (l *EventLog) rotated() ([]string, error) {
+	dir, base := filepath.Split(l.Path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, e := range entries {
+		suffix := strings.TrimPrefix(e.Name(), base+".")
+		if suffix == e.Name() || len(suffix) != len(eventLogSuffix) {
+			continue
+		}
+		if _, err := time.Parse(eventLogSuffix, suffix); err == nil {
+			rotated = append(rotated, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+func eventHash(key, line []byte) string {
+	if len(key) == 0 {
+		sum := sha256.Sum256(line)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(line)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrEventChainBroken is returned by VerifyEventLog when a line does not
+// follow the previous one.
+var ErrEventChainBroken = errors.New("event hash chain broken")
+
+// VerifyEventLog checks the hash chain of the lines written by an EventLog
+// with key, its EventLog.Key. prev is the hash the first line must follow,
+// the last hash of the previous file, or empty to accept any. It returns the
+// hash of the last line, to verify the next file with and to compare with
+// EventLog.Head.
+func VerifyEventLog(r io.Reader, key []byte, prev string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		var rec struct {
+			Prev *string `json:"prev"`
+		}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return "", fmt.Errorf("line %d: %w", n, err)
+		}
+		if rec.Prev == nil || (*rec.Prev != prev && (n != 1 || prev != "")) {
+			return "", fmt.Errorf("line %d: %w", n, ErrEventChainBroken)
+		}
+		prev = eventHash(key, line)
+	}
+	return prev, scanner.Err()
+}
+
+// EventWebhook is an EventSink that POSTs events in batches as a JSON array to URL.
+// Events are sent in the background, failed batches are retried with the next
+// one, and the oldest events are dropped if MaxPending events are waiting.
+type EventWebhook struct {
+	// URL is the endpoint
+	URL string
+	// Header is added to the requests, such as an Authorization
+	Header http.Header
+	// Client sends the requests, the default is http.DefaultClient
+	Client *http.Client
+	// BatchSize is the maximum number of events in a request, the default is 100
+	BatchSize int
+	// FlushInterval is how long events wait for a batch, the default is one second
+	FlushInterval time.Duration
+	// MaxPending is the maximum number of events waiting, the default is 10000
+	MaxPending int
+	// Logger logs failures if it is not nil
+	Logger Logger
+
+	once      sync.Once
+	closeOnce sync.Once
+	mut       sync.Mutex
+	pending   []*Event
+	dropped   int
+	// shifted counts the events dropped from the batch being sent
+	shifted int
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func (w *EventWebhook) start() {
+	w.once.Do(func() {
+		w.wake = make(chan struct{}, 1)
+		w.done = make(chan struct{})
+		w.stopped = make(chan struct{})
+		go w.run()
+	})
+}
+
+// Emit queues the event.
+func (w *EventWebhook) Emit(ev *Event) error {
+	w.start()
+	maxPending := w.MaxPending
+	if maxPending <= 0 {
+		maxPending = 10000
+	}
+	w.mut.Lock()
+	if len(w.pending) >= maxPending {
+		w.pending = w.pending[1:]
+		w.dropped++
+		w.shifted++
+	}
+	w.pending = append(w.pending, ev)
+	full := len(w.pending) >= w.batchSize()
+	w.mut.Unlock()
+	if full {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Close sends the pending events and stops, it may be called more than once.
+func (w *EventWebhook) Close() error {
+	w.start()
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	<-w.stopped
+	return nil
+}
+
+func (w *EventWebhook) batchSize() int {
+	if w.BatchSize <= 0 {
+		return 100
+	}
+	return w.BatchSize
+}
+
+func (w *EventWebhook) run() {
+	defer close(w.stopped)
+	interval := w.FlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			w.flush()
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+		w.flush()
+	}
+}
+
+// flush sends the pending events in batches until one fails.
+func (w *EventWebhook) flush() {
+	for {
+		w.mut.Lock()
+		if w.dropped != 0 && w.Logger != nil {
+			w.Logger.Println("event webhook dropped", w.dropped, "events")
+		}
+		w.dropped = 0
+		n := len(w.pending)
+		if n > w.batchSize() {
+			n = w.batchSize()
+		}
+		batch := w.pending[:n:n]
+		w.shifted = 0
+		w.mut.Unlock()
+		if n == 0 {
+			return
+		}
+
+		if err := w.send(batch); err != nil {
+			if w.Logger != nil {
+				w.Logger.Println("event webhook failed:", err)
+			}
+			return
+		}
+		w.mut.Lock()
+		// Events of the batch dropped while sending are already gone.
+		if n > w.shifted {
+			w.pending = w.pending[n-w.shifted:]
+		}
+		w.mut.Unlock()
+	}
+}
+
+func (w *EventWebhook) send(batch []*Event) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range w.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Content-Type", "application/json")
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
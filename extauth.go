@@ -0,0 +1,268 @@
+package socks4
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultExternalAuthTimeout is the timeout of external authentication if none is set.
+const defaultExternalAuthTimeout = 5 * time.Second
+
+// AuthQuery is the authentication decision asked of WebhookAuth and ExecAuth.
+type AuthQuery struct {
+	Username string `json:"username"`
+	// Command is "connect" or "bind"
+	Command string `json:"command"`
+	// Client is the IP of the client, it is empty if unknown
+	Client string `json:"client,omitempty"`
+	// Destination is the requested "host:port", it is empty if unknown
+	Destination string `json:"destination,omitempty"`
+}
+
+func newAuthQuery(req *Request) AuthQuery {
+	q := AuthQuery{
+		Username: req.Username,
+		Command:  commandName(req.Command),
+	}
+	if req.Conn != nil {
+		if ip := addrIP(req.Conn.RemoteAddr()); ip != nil {
+			q.Client = ip.String()
+		}
+	}
+	if req.DestinationAddr != nil {
+		q.Destination = req.DestinationAddr.Address()
+	}
+	return q
+}
+
+func commandName(cmd Command) string {
+	switch cmd {
+	case ConnectCommand:
+		return "connect"
+	case BindCommand:
+		return "bind"
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+// maxAuthCacheEntries bounds the decisions cached by WebhookAuth and ExecAuth,
+// the least recently used ones are dropped first.
+const maxAuthCacheEntries = 1024
+
+// externalAuth is what WebhookAuth and ExecAuth share:
+// the cache, the timeout and the behavior on failure.
+type externalAuth struct {
+	mut     sync.Mutex
+	entries map[AuthQuery]*list.Element
+	lru     list.List
+}
+
+type authCacheEntry struct {
+	query   AuthQuery
+	allow   bool
+	expires time.Time
+}
+
+// cached returns the unexpired decision about q.
+func (e *externalAuth) cached(q AuthQuery, now time.Time) (allow, ok bool) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	el, ok := e.entries[q]
+	if !ok {
+		return false, false
+	}
+	entry := el.Value.(*authCacheEntry)
+	if !now.Before(entry.expires) {
+		e.lru.Remove(el)
+		delete(e.entries, q)
+		return false, false
+	}
+	e.lru.MoveToFront(el)
+	return entry.allow, true
+}
+
+func (e *externalAuth) store(q AuthQuery, allow bool, expires time.Time) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.entries == nil {
+		e.entries = map[AuthQuery]*list.Element{}
+	}
+	if el, ok := e.entries[q]; ok {
+		el.Value = &authCacheEntry{query: q, allow: allow, expires: expires}
+		e.lru.MoveToFront(el)
+		return
+	}
+	e.entries[q] = e.lru.PushFront(&authCacheEntry{query: q, allow: allow, expires: expires})
+	for e.lru.Len() > maxAuthCacheEntries {
+		el := e.lru.Back()
+		e.lru.Remove(el)
+		delete(e.entries, el.Value.(*authCacheEntry).query)
+	}
+}
+
+// auth asks for a decision about req, which is abandoned and rejected when
+// the context of the request is done, whatever failOpen is.
+func (e *externalAuth) auth(req *Request, ttl, timeout time.Duration, failOpen bool, logger Logger,
+	ask func(ctx context.Context, q AuthQuery) (bool, error)) bool {
+	q := newAuthQuery(req)
+	now := time.Now()
+	if ttl > 0 {
+		if allow, ok := e.cached(q, now); ok {
+			return allow
+		}
+	}
+
+	if timeout <= 0 {
+		timeout = defaultExternalAuthTimeout
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	allow, err := ask(ctx, q)
+	if err != nil {
+		if req.Context().Err() != nil {
+			// The session ended, the backend did not fail.
+			return false
+		}
+		if logger != nil {
+			logger.Println("external authentication of", q.Username, "failed:", err)
+		}
+		return failOpen
+	}
+
+	if ttl > 0 {
+		e.store(q, allow, now.Add(ttl))
+	}
+	return allow
+}
+
+// WebhookAuth is an Authentication that POSTs an AuthQuery as JSON to URL.
+// The endpoint replies 200 with {"allow": true} or {"allow": false},
+// any other response is a failure.
+type WebhookAuth struct {
+	// URL is the endpoint
+	URL string
+	// Header is added to the requests, such as an Authorization
+	Header http.Header
+	// Client sends the requests, the default is http.DefaultClient
+	Client *http.Client
+	// Timeout is the time allowed for a decision, the default is five seconds
+	Timeout time.Duration
+	// CacheTTL is how long decisions are cached, they are not cached if it is zero
+	CacheTTL time.Duration
+	// FailOpen allows requests when the endpoint fails or times out instead of
+	// rejecting them, requests whose session ended are still rejected
+	FailOpen bool
+	// Logger logs failures if it is not nil
+	Logger Logger
+
+	ext externalAuth
+}
+
+// Auth asks the endpoint about the username and command.
+func (a *WebhookAuth) Auth(cmd Command, username string) bool {
+	return a.AuthRequest(&Request{Command: cmd, Username: username})
+}
+
+// AuthRequest asks the endpoint about the request.
+func (a *WebhookAuth) AuthRequest(req *Request) bool {
+	return a.ext.auth(req, a.CacheTTL, a.Timeout, a.FailOpen, a.Logger, a.ask)
+}
+
+func (a *WebhookAuth) ask(ctx context.Context, q AuthQuery) (bool, error) {
+	body, err := json.Marshal(q)
+	if err != nil {
+		return false, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range a.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Content-Type", "application/json")
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var decision struct {
+		Allow *bool `json:"allow"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&decision); err != nil {
+		return false, err
+	}
+	if decision.Allow == nil {
+		return false, errors.New(`missing "allow" in response`)
+	}
+	return *decision.Allow, nil
+}
+
+// ExecAuth is an Authentication that runs an executable with an AuthQuery
+// as JSON on its standard input. Exit status 0 allows the request and 1
+// rejects it, anything else is a failure.
+type ExecAuth struct {
+	// Path is the executable
+	Path string
+	// Args are the arguments of the executable
+	Args []string
+	// Timeout is the time allowed for a decision, the default is five seconds
+	Timeout time.Duration
+	// CacheTTL is how long decisions are cached, they are not cached if it is zero
+	CacheTTL time.Duration
+	// FailOpen allows requests when the executable fails or times out instead of
+	// rejecting them, requests whose session ended are still rejected
+	FailOpen bool
+	// Logger logs failures if it is not nil
+	Logger Logger
+
+	ext externalAuth
+}
+
+// Auth asks the executable about the username and command.
+func (a *ExecAuth) Auth(cmd Command, username string) bool {
+	return a.AuthRequest(&Request{Command: cmd, Username: username})
+}
+
+// AuthRequest asks the executable about the request.
+func (a *ExecAuth) AuthRequest(req *Request) bool {
+	return a.ext.auth(req, a.CacheTTL, a.Timeout, a.FailOpen, a.Logger, a.ask)
+}
+
+func (a *ExecAuth) ask(ctx context.Context, q AuthQuery) (bool, error) {
+	input, err := json.Marshal(q)
+	if err != nil {
+		return false, err
+	}
+	cmd := exec.CommandContext(ctx, a.Path, a.Args...)
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	err = cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && ctx.Err() == nil {
+		return false, nil
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	return false, err
+}
@@ -0,0 +1,156 @@
+package socks4
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/wzshiming/socks4/protocol"
+)
+
+// Handler responds to a request that passed authentication.
+//
+// The handler replies to the client through Request.Reply and owns the
+// client connection until it returns, after which the connection is closed
+// unless the handler took it over with Request.Hijack.
+type Handler interface {
+	ServeSOCKS4(req *Request) error
+}
+
+// HandlerFunc Handler interface is implemented
+type HandlerFunc func(req *Request) error
+
+// ServeSOCKS4 calls f(req).
+func (f HandlerFunc) ServeSOCKS4(req *Request) error {
+	return f(req)
+}
+
+// Request is a request received by the server.
+type Request struct {
+	// ID identifies the session in events
+	ID string
+	// Version is the SOCKS version of the request
+	Version uint8
+	// Command is the command of the request
+	Command Command
+	// DestinationAddr is the destination of the request
+	DestinationAddr *protocol.Addr
+	// OriginalDestinationAddr is the destination sent by the client
+	// if DestinationAddr was rewritten, otherwise it is nil
+	OriginalDestinationAddr *protocol.Addr
+	// Username is the USERID of the request, or the identity verified by a
+	// RequestAuthentication once it is authenticated
+	Username string
+	// Conn is the client connection
+	Conn net.Conn
+	// SniffedHost is the TLS SNI or HTTP Host sent by the client
+	// in a CONNECT tunnel, if the server sniffs it
+	SniffedHost string
+	// RateLimit limits the tunnel to this many bytes per second in each
+	// direction if it is positive, a RequestAuthentication may set it
+	RateLimit int64
+
+	hijacked bool
+	ctx      context.Context
+	counters sessionCounters
+	// dialFailure is the class of the failed CONNECT, if it failed
+	dialFailure DialFailure
+	// quota is the usage the tunnel adds to, once the request is granted
+	quota *quotaCounter
+}
+
+// Context returns the context of the session, which carries its metadata
+// and is cancelled when the session ends or Server.Context is done.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Reply sends a reply to the client with the bound address,
+// which is sent as 0.0.0.0:0 if addr is nil or not an IPv4 address.
+func (r *Request) Reply(code ReplyCode, addr net.Addr) error {
+	return sendReply(r.Conn, code, replyAddr(addr))
+}
+
+// destination describes the destination of the request for logs.
+func (r *Request) destination() string {
+	if r.OriginalDestinationAddr == nil {
+		return r.DestinationAddr.String()
+	}
+	return r.DestinationAddr.String() + " (rewritten from " + r.OriginalDestinationAddr.String() + ")"
+}
+
+// requestedDestination is the destination sent by the client, which rules check.
+func (r *Request) requestedDestination() *address {
+	if r.OriginalDestinationAddr != nil {
+		return r.OriginalDestinationAddr
+	}
+	return r.DestinationAddr
+}
+
+// sniffedDestination is the requested destination with the sniffed hostname, for rules.
+func (r *Request) sniffedDestination() *address {
+	dest := r.requestedDestination()
+	return &address{
+		Name: r.SniffedHost,
+		IP:   dest.IP,
+		Port: dest.Port,
+	}
+}
+
+// Hijack lets the caller take over the client connection,
+// the server will not close it after the handler returns.
+func (r *Request) Hijack() net.Conn {
+	r.hijacked = true
+	return r.Conn
+}
+
+// Handle registers the handler for the command.
+func (s *Server) Handle(cmd Command, h Handler) {
+	if s.Handlers == nil {
+		s.Handlers = map[Command]Handler{}
+	}
+	s.Handlers[cmd] = h
+}
+
+// DefaultHandler returns the built-in handler for the command,
+// which handlers can delegate to. Commands other than CONNECT and BIND
+// are rejected.
+func (s *Server) DefaultHandler(cmd Command) Handler {
+	switch cmd {
+	case ConnectCommand:
+		return HandlerFunc(s.handleConnect)
+	case BindCommand:
+		return HandlerFunc(s.handleBind)
+	default:
+		return HandlerFunc(s.handleUnsupported)
+	}
+}
+
+func (s *Server) handler(cmd Command) Handler {
+	if h, ok := s.Handlers[cmd]; ok && h != nil {
+		return h
+	}
+	return s.DefaultHandler(cmd)
+}
+
+func (s *Server) handleUnsupported(req *Request) error {
+	if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+		return phaseError(PhaseHandshake, err)
+	}
+	return phaseError(PhaseHandshake, fmt.Errorf("unsupported Command: %v", req.Command))
+}
+
+// replyAddr converts addr to the address in a reply.
+func replyAddr(addr net.Addr) *address {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &address{IP: a.IP, Port: a.Port}
+	case *address:
+		return a
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+package socks4
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Hooks are called at each stage of a session, every hook is optional.
+// Hooks returning an error end the session with it.
+type Hooks struct {
+	// OnAccept is called with a client connection that passed ClientRules
+	// and Bans, before the request is read. An error closes the connection.
+	OnAccept func(conn net.Conn) error
+	// OnRequest is called with an authenticated request before it is handled,
+	// it may modify the request. An error rejects the request.
+	OnRequest func(req *Request) error
+	// OnDial is called with the connection to the destination of a CONNECT,
+	// and returns the connection to use, which may replace it.
+	// An error rejects the request.
+	OnDial func(req *Request, conn net.Conn) (net.Conn, error)
+	// OnBindListen is called with the listener of a BIND before its address
+	// is announced. An error rejects the request.
+	OnBindListen func(req *Request, l net.Listener) error
+	// OnBindAccept is called with the peer accepted by a BIND.
+	// An error rejects the peer and the request.
+	OnBindAccept func(req *Request, conn net.Conn) error
+	// OnClose is called at the end of every session that passed OnAccept.
+	OnClose func(req *Request, stats SessionStats)
+}
+
+// SessionStats are the statistics of a session.
+type SessionStats struct {
+	// Start is when the client connection was accepted
+	Start time.Time
+	// Duration is how long the session lasted
+	Duration time.Duration
+	// BytesIn is the number of bytes tunneled from the client
+	BytesIn int64
+	// BytesOut is the number of bytes tunneled to the client
+	BytesOut int64
+	// DialFailure is the class of the failure if the CONNECT failed
+	DialFailure DialFailure
+	// SniffedHost is Request.SniffedHost
+	SniffedHost string
+	// Err is why the session ended, nil if it ended normally
+	Err error
+}
+
+// sessionCounters count the bytes of a tunnel.
+type sessionCounters struct {
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+// countConn counts the data read from the connection.
+type countConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.n.Add(int64(n))
+	}
+	return n, err
+}
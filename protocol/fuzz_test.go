@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte{4, 1, 0, 80, 127, 0, 0, 1, 'u', 0})
+	f.Add([]byte{4, 2, 0x27, 0x10, 0, 0, 0, 0, 0, 'd', 'a', 't', 'a'})
+	f.Add([]byte{4, 1, 1, 0xbb, 0, 0, 0, 1, 0, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0})
+	f.Add([]byte{4, 1, 0, 80, 0, 0, 0, 1, 'u', 0, 'h', 0, 'p', 'a', 'y'})
+
+	limits := Limits{MaxUserIDLength: 16, MaxHostnameLength: 32}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		plain := bytes.NewReader(data)
+		want, wantErr := limits.ReadRequest(plain)
+
+		br := bufio.NewReaderSize(bytes.NewReader(data), 16)
+		got, gotErr := limits.ReadRequest(br)
+
+		if (wantErr == nil) != (gotErr == nil) {
+			t.Fatalf("unbuffered error %v, buffered error %v", wantErr, gotErr)
+		}
+		if wantErr != nil {
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unbuffered %#v, buffered %#v", want, got)
+		}
+		if len(got.UserID) > limits.MaxUserIDLength || len(got.Addr.Name) > limits.MaxHostnameLength {
+			t.Fatalf("limits exceeded: %#v", got)
+		}
+
+		// The buffered reader must not consume what follows the request.
+		rest, err := io.ReadAll(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, data[len(data)-plain.Len():]) {
+			t.Fatalf("remaining %q, want %q", rest, data[len(data)-plain.Len():])
+		}
+
+		var buf bytes.Buffer
+		if err := WriteRequest(&buf, got); err != nil {
+			t.Fatal(err)
+		}
+		again, err := limits.ReadRequest(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(again, got) {
+			t.Fatalf("round trip %#v, want %#v", again, got)
+		}
+	})
+}
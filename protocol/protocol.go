@@ -0,0 +1,394 @@
+// Package protocol implements the SOCKS4 and SOCKS4a wire format.
+//
+// A request sent by the client is
+//
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+//	+----+----+----+----+----+----+----+----+----+----+....+----+
+//	   1    1      2              4           variable       1
+//
+// followed, for SOCKS4a, by a NUL terminated hostname when DSTIP is 0.0.0.x
+// with x nonzero. A reply sent by the server is
+//
+//	+----+----+----+----+----+----+----+----+
+//	| VN | CD | DSTPORT |      DSTIP        |
+//	+----+----+----+----+----+----+----+----+
+//	   1    1      2              4
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Version is the SOCKS protocol version of requests.
+const Version = 0x04
+
+// ReplyVersion is the version of replies.
+const ReplyVersion = 0x00
+
+var (
+	// ErrInvalidVersion is returned when a request does not start with Version.
+	ErrInvalidVersion = errors.New("unsupported SOCKS version")
+	// ErrInvalidReplyVersion is returned when a reply does not start with ReplyVersion.
+	ErrInvalidReplyVersion = errors.New("unsupported SOCKS reply version")
+	// ErrInvalidReplyCode is returned when a reply code is not one of the defined codes.
+	ErrInvalidReplyCode = errors.New("unknown SOCKS reply code")
+	// ErrInvalidPort is returned when a request has port 0 or a port out of range.
+	ErrInvalidPort = errors.New("invalid port")
+	// ErrInvalidAddr is returned when a request has neither an IPv4 address nor a hostname.
+	ErrInvalidAddr = errors.New("invalid address")
+	// ErrInvalidUserID is returned when a USERID contains a non-printable byte.
+	ErrInvalidUserID = errors.New("invalid USERID")
+	// ErrInvalidHostname is returned when a SOCKS4a hostname is empty or contains a non-printable byte.
+	ErrInvalidHostname = errors.New("invalid hostname")
+	// ErrUserIDTooLong is returned when a USERID is longer than the limit.
+	ErrUserIDTooLong = errors.New("USERID too long")
+	// ErrHostnameTooLong is returned when a SOCKS4a hostname is longer than the limit.
+	ErrHostnameTooLong = errors.New("hostname too long")
+)
+
+const (
+	// DefaultMaxUserIDLength is the default limit of the USERID length.
+	DefaultMaxUserIDLength = 255
+	// DefaultMaxHostnameLength is the default limit of the SOCKS4a hostname length,
+	// which is the maximum length of a domain name.
+	DefaultMaxHostnameLength = 255
+)
+
+const (
+	ConnectCommand Command = 0x01
+	BindCommand    Command = 0x02
+)
+
+// Command is a SOCKS Command.
+type Command byte
+
+func (cmd Command) String() string {
+	switch cmd {
+	case ConnectCommand:
+		return "socks connect"
+	case BindCommand:
+		return "socks bind"
+	default:
+		return "socks " + strconv.Itoa(int(cmd))
+	}
+}
+
+const (
+	GrantedReply     ReplyCode = 0x5a
+	RejectedReply    ReplyCode = 0x5b
+	NoIdentdReply    ReplyCode = 0x5c
+	InvalidUserReply ReplyCode = 0x5d
+)
+
+// ReplyCode is a SOCKS Command reply code.
+type ReplyCode byte
+
+func (code ReplyCode) String() string {
+	switch code {
+	case GrantedReply:
+		return "request granted"
+	case RejectedReply:
+		return "request rejected or failed"
+	case NoIdentdReply:
+		return "request rejected because SOCKS server cannot connect to identd on the client"
+	case InvalidUserReply:
+		return "request rejected because the client program and identd report different user-ids"
+	default:
+		return "unknown code: " + strconv.Itoa(int(code))
+	}
+}
+
+func (code ReplyCode) valid() bool {
+	switch code {
+	case GrantedReply, RejectedReply, NoIdentdReply, InvalidUserReply:
+		return true
+	}
+	return false
+}
+
+// Addr is a SOCKS-specific address.
+// Either Name or IP is used exclusively.
+type Addr struct {
+	Name string // fully-qualified domain name
+	IP   net.IP
+	Port int
+}
+
+func (a *Addr) Network() string { return "socks4" }
+
+func (a *Addr) String() string {
+	if a == nil {
+		return "<nil>"
+	}
+	return a.Address()
+}
+
+// Address returns a string suitable to dial; prefer returning IP-based
+// address, fallback to Name
+func (a Addr) Address() string {
+	port := strconv.Itoa(a.Port)
+	if a.Name != "" {
+		return net.JoinHostPort(a.Name, port)
+	}
+	return net.JoinHostPort(a.IP.String(), port)
+}
+
+// Request is a request sent by the client.
+type Request struct {
+	Command Command
+	// Addr is the destination; a non-empty Name makes it a SOCKS4a request
+	Addr   Addr
+	UserID string
+}
+
+// Reply is a reply sent by the server.
+type Reply struct {
+	Code ReplyCode
+	// Addr is the bound address, the IP is 0.0.0.0 if it is nil
+	Addr Addr
+}
+
+var (
+	socks4aIP = net.IPv4(0, 0, 0, 1).To4()
+	noneIP    = net.IPv4zero.To4()
+)
+
+// isSocks4a reports whether ip is 0.0.0.x with x nonzero,
+// which marks a SOCKS4a request followed by a hostname.
+func isSocks4a(ip net.IP) bool {
+	return ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+}
+
+// Limits bounds the variable length fields of a request.
+type Limits struct {
+	// MaxUserIDLength is the maximum USERID length,
+	// DefaultMaxUserIDLength is used if it is zero
+	MaxUserIDLength int
+	// MaxHostnameLength is the maximum SOCKS4a hostname length,
+	// DefaultMaxHostnameLength is used if it is zero
+	MaxHostnameLength int
+}
+
+// ReadRequest reads and validates a request, including the version byte,
+// with the default Limits.
+func ReadRequest(r io.Reader) (*Request, error) {
+	return Limits{}.ReadRequest(r)
+}
+
+// ReadRequest reads and validates a request, including the version byte.
+//
+// If r is a *bufio.Reader the variable length fields are parsed from its buffer,
+// otherwise r is read one byte at a time. Either way nothing after the request
+// is consumed from r, so the caller must keep reading from the same
+// *bufio.Reader to get the bytes that follow the request.
+func (l Limits) ReadRequest(r io.Reader) (*Request, error) {
+	// The version is checked before reading the rest of the header, since
+	// other protocols such as a SOCKS5 greeting may be shorter than it.
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
+		return nil, err
+	}
+	if header[0] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidVersion, header[0])
+	}
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return nil, err
+	}
+	req := &Request{
+		Command: Command(header[1]),
+	}
+	req.Addr.Port = int(header[2])<<8 | int(header[3])
+	if req.Addr.Port == 0 {
+		return nil, ErrInvalidPort
+	}
+	ip := net.IP(header[4:8])
+
+	maxUserID := l.MaxUserIDLength
+	if maxUserID <= 0 {
+		maxUserID = DefaultMaxUserIDLength
+	}
+	userID, err := readString(r, maxUserID)
+	if err != nil {
+		if err == errTooLong {
+			return nil, ErrUserIDTooLong
+		}
+		return nil, err
+	}
+	if !printable(userID) {
+		return nil, ErrInvalidUserID
+	}
+	req.UserID = string(userID)
+
+	if isSocks4a(ip) {
+		maxHostname := l.MaxHostnameLength
+		if maxHostname <= 0 {
+			maxHostname = DefaultMaxHostnameLength
+		}
+		hostname, err := readString(r, maxHostname)
+		if err != nil {
+			if err == errTooLong {
+				return nil, ErrHostnameTooLong
+			}
+			return nil, err
+		}
+		if len(hostname) == 0 || !printable(hostname) {
+			return nil, ErrInvalidHostname
+		}
+		req.Addr.Name = string(hostname)
+	} else {
+		req.Addr.IP = append(net.IP(nil), ip...)
+	}
+	return req, nil
+}
+
+// WriteRequest validates and writes a request, including the version byte.
+func WriteRequest(w io.Writer, req *Request) error {
+	if req.Addr.Port < 1 || req.Addr.Port > 0xffff {
+		return ErrInvalidPort
+	}
+	if !printable([]byte(req.UserID)) {
+		return ErrInvalidUserID
+	}
+	var ip net.IP
+	if req.Addr.Name != "" {
+		if !printable([]byte(req.Addr.Name)) {
+			return ErrInvalidHostname
+		}
+		ip = socks4aIP
+	} else {
+		ip = req.Addr.IP.To4()
+		if ip == nil {
+			return ErrInvalidAddr
+		}
+	}
+
+	buf := make([]byte, 0, 8+len(req.UserID)+1+len(req.Addr.Name)+1)
+	buf = append(buf, Version, byte(req.Command), byte(req.Addr.Port>>8), byte(req.Addr.Port))
+	buf = append(buf, ip...)
+	buf = append(buf, req.UserID...)
+	buf = append(buf, 0)
+	if req.Addr.Name != "" {
+		buf = append(buf, req.Addr.Name...)
+		buf = append(buf, 0)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadReply reads and validates a reply.
+func ReadReply(r io.Reader) (*Reply, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	if buf[0] != ReplyVersion {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidReplyVersion, buf[0])
+	}
+	rep := &Reply{
+		Code: ReplyCode(buf[1]),
+	}
+	if !rep.Code.valid() {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidReplyCode, buf[1])
+	}
+	rep.Addr.Port = int(buf[2])<<8 | int(buf[3])
+	rep.Addr.IP = append(net.IP(nil), buf[4:8]...)
+	return rep, nil
+}
+
+// WriteReply validates and writes a reply.
+// The IP of the address is written as 0.0.0.0 if it is not an IPv4 address.
+func WriteReply(w io.Writer, rep *Reply) error {
+	if !rep.Code.valid() {
+		return fmt.Errorf("%w: %d", ErrInvalidReplyCode, rep.Code)
+	}
+	if rep.Addr.Port < 0 || rep.Addr.Port > 0xffff {
+		return ErrInvalidPort
+	}
+	ip := rep.Addr.IP.To4()
+	if ip == nil {
+		ip = noneIP
+	}
+	var buf [8]byte
+	buf[0] = ReplyVersion
+	buf[1] = byte(rep.Code)
+	buf[2] = byte(rep.Addr.Port >> 8)
+	buf[3] = byte(rep.Addr.Port)
+	copy(buf[4:], ip)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+var errTooLong = errors.New("too long")
+
+// readString reads a NUL terminated string of at most max bytes.
+func readString(r io.Reader, max int) ([]byte, error) {
+	if br, ok := r.(*bufio.Reader); ok {
+		return readBufferedString(br, max)
+	}
+	buf := []byte{}
+	var data [1]byte
+	for {
+		_, err := io.ReadFull(r, data[:])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if data[0] == 0 {
+			return buf, nil
+		}
+		if len(buf) == max {
+			return nil, errTooLong
+		}
+		buf = append(buf, data[0])
+	}
+}
+
+// readBufferedString is readString for a *bufio.Reader, which scans the
+// buffered bytes and discards only up to the terminating NUL.
+func readBufferedString(br *bufio.Reader, max int) ([]byte, error) {
+	var buf []byte
+	for {
+		if br.Buffered() == 0 {
+			// Block until more data is available.
+			if _, err := br.Peek(1); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+		}
+		data, _ := br.Peek(br.Buffered())
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			if len(buf)+i > max {
+				return nil, errTooLong
+			}
+			buf = append(buf, data[:i]...)
+			_, _ = br.Discard(i + 1)
+			return buf, nil
+		}
+		if len(buf)+len(data) > max {
+			return nil, errTooLong
+		}
+		buf = append(buf, data...)
+		_, _ = br.Discard(len(data))
+	}
+}
+
+// printable reports whether s only contains printable ASCII characters.
+func printable(s []byte) bool {
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []*Request{
+		{Command: ConnectCommand, Addr: Addr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 80}, UserID: "u"},
+		{Command: BindCommand, Addr: Addr{IP: net.IPv4zero.To4(), Port: 1080}},
+		{Command: ConnectCommand, Addr: Addr{Name: "example.com", Port: 443}, UserID: "user"},
+	}
+	for _, want := range tests {
+		var buf bytes.Buffer
+		if err := WriteRequest(&buf, want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadRequest(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d bytes left unread", buf.Len())
+		}
+	}
+}
+
+func TestReadRequestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"version", []byte{5, 1, 0, 80, 1, 2, 3, 4, 0}, ErrInvalidVersion},
+		{"socks5 greeting", []byte{5, 1, 0}, ErrInvalidVersion},
+		{"port", []byte{4, 1, 0, 0, 1, 2, 3, 4, 0}, ErrInvalidPort},
+		{"hostname", []byte{4, 1, 0, 80, 0, 0, 0, 9, 0, 0}, ErrInvalidHostname},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadRequest(bytes.NewReader(tt.data))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestWriteRequestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *Request
+		err  error
+	}{
+		{"port", &Request{Addr: Addr{IP: net.IPv4(1, 2, 3, 4)}}, ErrInvalidPort},
+		{"ipv6", &Request{Addr: Addr{IP: net.IPv6loopback, Port: 80}}, ErrInvalidAddr},
+		{"userid", &Request{Addr: Addr{IP: net.IPv4(1, 2, 3, 4), Port: 80}, UserID: "a\x00b"}, ErrInvalidUserID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := WriteRequest(&bytes.Buffer{}, tt.req)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	want := &Reply{Code: GrantedReply, Addr: Addr{IP: net.IPv4(192, 168, 1, 1).To4(), Port: 1234}}
+	var buf bytes.Buffer
+	if err := WriteReply(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadReply(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+
+	_, err = ReadReply(bytes.NewReader([]byte{4, 0x5a, 0, 0, 0, 0, 0, 0}))
+	if !errors.Is(err, ErrInvalidReplyVersion) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidReplyVersion)
+	}
+	_, err = ReadReply(bytes.NewReader([]byte{0, 0x10, 0, 0, 0, 0, 0, 0}))
+	if !errors.Is(err, ErrInvalidReplyCode) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidReplyCode)
+	}
+}
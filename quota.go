@@ -0,0 +1,304 @@
+package socks4
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by the server when a user runs out of quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaPeriod is the period after which quota usage is reset.
+type QuotaPeriod int
+
+const (
+	// QuotaMonthly resets usage at the start of every month in UTC.
+	QuotaMonthly QuotaPeriod = iota
+	// QuotaDaily resets usage at the start of every day in UTC.
+	QuotaDaily
+)
+
+func (p QuotaPeriod) key(t time.Time) string {
+	t = t.UTC()
+	if p == QuotaDaily {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01")
+}
+
+// next returns the start of the period after the one of t.
+func (p QuotaPeriod) next(t time.Time) time.Time {
+	t = t.UTC()
+	if p == QuotaDaily {
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// QuotaLimit is the usage allowed in a period, zero fields mean no limit.
+type QuotaLimit struct {
+	// Bytes is the traffic in both directions
+	Bytes int64
+	// Sessions is the number of sessions started
+	Sessions int64
+}
+
+// QuotaUsage is the usage of a user in the current period.
+type QuotaUsage struct {
+	Bytes    int64 `json:"bytes"`
+	Sessions int64 `json:"sessions"`
+}
+
+// Quota enforces per-username traffic and session limits per period.
+// Usage is kept by the username of the authenticated request, which is the
+// principal for TokenAuth. A session counts once its request is granted,
+// over-quota requests are rejected and sessions are cut when the traffic
+// limit is reached mid-transfer.
+type Quota struct {
+	// Period is when usage is reset
+	Period QuotaPeriod
+	// Default is the limit of users not in Users
+	Default QuotaLimit
+	// Users are the limits by username
+	Users map[string]QuotaLimit
+	// Now returns the current time, the default is time.Now
+	Now func() time.Time
+
+	path string
+	// mut guards period, usage and timer, the counters are atomic
+	mut    sync.Mutex
+	period string
+	usage  map[string]*quotaCounter
+	// timer resets the usage at the start of the next period
+	timer *time.Timer
+	dirty atomic.Bool
+}
+
+// quotaCounter is the usage of a user, tunnels add to it without locking.
+type quotaCounter struct {
+	bytes    atomic.Int64
+	sessions atomic.Int64
+}
+
+type quotaFile struct {
+	Period string                 `json:"period"`
+	Usage  map[string]*QuotaUsage `json:"usage"`
+}
+
+// NewQuota returns a Quota that persists usage to the file at path,
+// loading the usage already in it. Usage is not persisted if path is empty.
+func NewQuota(path string) (*Quota, error) {
+	q := &Quota{
+		path:  path,
+		usage: map[string]*quotaCounter{},
+	}
+	if path == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return nil, err
+	}
+	var file quotaFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	q.period = file.Period
+	for username, u := range file.Usage {
+		c := &quotaCounter{}
+		c.bytes.Store(u.Bytes)
+		c.sessions.Store(u.Sessions)
+		q.usage[username] = c
+	}
+	return q, nil
+}
+
+// Save writes the usage to the file if it changed since the last save.
+func (q *Quota) Save() error {
+	if q.path == "" || !q.dirty.Swap(false) {
+		return nil
+	}
+	q.mut.Lock()
+	file := quotaFile{Period: q.period, Usage: map[string]*QuotaUsage{}}
+	for username, u := range q.usage {
+		if usage := u.load(); usage != (QuotaUsage{}) {
+			file.Usage[username] = &usage
+		}
+	}
+	q.mut.Unlock()
+	data, err := json.Marshal(file)
+	if err != nil {
+		q.dirty.Store(true)
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		q.dirty.Store(true)
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		q.dirty.Store(true)
+	}
+	return err
+}
+
+// Run saves the usage every interval until ctx is done, and once more then.
+// Failed saves are logged if logger is not nil.
+func (q *Quota) Run(ctx context.Context, interval time.Duration, logger Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := q.Save(); err != nil && logger != nil {
+				logger.Println("save quota usage failed:", err)
+			}
+			return
+		case <-ticker.C:
+			if err := q.Save(); err != nil && logger != nil {
+				logger.Println("save quota usage failed:", err)
+			}
+		}
+	}
+}
+
+// Usage returns the usage of the user in the current period.
+func (q *Quota) Usage(username string) QuotaUsage {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.rollover()
+	if u, ok := q.usage[username]; ok {
+		return u.load()
+	}
+	return QuotaUsage{}
+}
+
+func (u *quotaCounter) load() QuotaUsage {
+	return QuotaUsage{Bytes: u.bytes.Load(), Sessions: u.sessions.Load()}
+}
+
+func (q *Quota) limit(username string) QuotaLimit {
+	if l, ok := q.Users[username]; ok {
+		return l
+	}
+	return q.Default
+}
+
+func (q *Quota) now() time.Time {
+	if q.Now != nil {
+		return q.Now()
+	}
+	return time.Now()
+}
+
+// rollover resets the usage when a new period starts. The counters are
+// reset in place, since the tunnels of the user keep adding to them.
+func (q *Quota) rollover() {
+	period := q.Period.key(q.now())
+	if period != q.period {
+		q.period = period
+		for _, u := range q.usage {
+			u.bytes.Store(0)
+			u.sessions.Store(0)
+		}
+		q.dirty.Store(true)
+	}
+}
+
+// schedule starts the timer that rolls the usage over at the start of the
+// next period, so that long tunnels do not check the period on every read.
+func (q *Quota) schedule() {
+	now := q.now()
+	d := q.Period.next(now).Sub(now)
+	if q.timer == nil {
+		q.timer = time.AfterFunc(d, func() {
+			q.mut.Lock()
+			defer q.mut.Unlock()
+			q.rollover()
+			q.schedule()
+		})
+		return
+	}
+	q.timer.Reset(d)
+}
+
+// exceeded reports whether the user is out of quota, before the session counts.
+func (u *quotaCounter) exceeded(limit QuotaLimit) bool {
+	return limit.Sessions > 0 && u.sessions.Load() >= limit.Sessions ||
+		limit.Bytes > 0 && u.bytes.Load() >= limit.Bytes
+}
+
+// check returns ErrQuotaExceeded if the user is out of quota,
+// without counting a session.
+func (q *Quota) check(username string) error {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.rollover()
+	if u, ok := q.usage[username]; ok && u.exceeded(q.limit(username)) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// begin counts a granted session of the user, unless the user is out of
+// quota, and returns the counter its traffic is added to.
+func (q *Quota) begin(username string) (*quotaCounter, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.rollover()
+	if q.timer == nil {
+		q.schedule()
+	}
+	u, ok := q.usage[username]
+	if !ok {
+		u = &quotaCounter{}
+		q.usage[username] = u
+	}
+	if u.exceeded(q.limit(username)) {
+		return nil, ErrQuotaExceeded
+	}
+	u.sessions.Add(1)
+	q.dirty.Store(true)
+	return u, nil
+}
+
+// quotaConn counts the data read from the connection against the quota of a user.
+type quotaConn struct {
+	net.Conn
+	quota *Quota
+	usage *quotaCounter
+	// limit is the traffic limit of the user, none if it is not positive
+	limit int64
+}
+
+func (c *quotaConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if !c.quota.dirty.Load() {
+			c.quota.dirty.Store(true)
+		}
+		if used := c.usage.bytes.Add(int64(n)); c.limit > 0 && used > c.limit {
+			return 0, ErrQuotaExceeded
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,62 @@
+package socks4
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that refills at rate bytes per second,
+// holding up to one second of tokens.
+type rateLimiter struct {
+	mut    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may pass.
+func (l *rateLimiter) wait(n int) {
+	l.mut.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mut.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// rateLimitedConn limits the rate of reads from the connection.
+type rateLimitedConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	// Keep reads small enough for the bucket, so that bursts stay bounded.
+	if max := int(c.limiter.rate); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limiter.wait(n)
+	}
+	return n, err
+}
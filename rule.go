@@ -0,0 +1,170 @@
+package socks4
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/wzshiming/socks4/protocol"
+)
+
+// DestinationMatch matches the destination of requests.
+// The zero value matches any destination.
+type DestinationMatch struct {
+	// Host matches the hostname of SOCKS4a requests if it is not empty,
+	// it is an exact name, "*.example.com" for any subdomain of example.com, or "*"
+	Host string
+	// Network matches the IP of requests if it is not nil
+	Network *net.IPNet
+	// Port matches the port if it is not zero
+	Port int
+}
+
+// Match reports whether the destination is matched.
+func (m *DestinationMatch) Match(addr *protocol.Addr) bool {
+	if m.Port != 0 && m.Port != addr.Port {
+		return false
+	}
+	if m.Host != "" {
+		if addr.Name == "" || !matchHost(m.Host, addr.Name) {
+			return false
+		}
+	}
+	if m.Network != nil {
+		if addr.IP == nil || !m.Network.Contains(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHost(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// Rule allows or denies the destinations it matches.
+type Rule struct {
+	DestinationMatch
+	// Deny denies the matched destinations instead of allowing them
+	Deny bool
+}
+
+// allowed reports whether the first matching rule allows the destination,
+// a destination that no rule matches is allowed.
+func (s *Server) allowed(addr *address) bool {
+	allow, _ := s.decide(addr, false)
+	return allow
+}
+
+// decide is allowed for a destination whose hostname may still be sniffed
+// if hostPending, it reports that nothing is decided yet when a rule
+// with a Host could be the first to match once the hostname is known.
+func (s *Server) decide(addr *address, hostPending bool) (allow, decided bool) {
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+		if hostPending && rule.Host != "" {
+			other := rule.DestinationMatch
+			other.Host = ""
+			if other.Match(addr) {
+				return true, false
+			}
+			continue
+		}
+		if rule.Match(addr) {
+			return !rule.Deny, true
+		}
+	}
+	return true, true
+}
+
+// ClientRule allows or denies the clients it matches.
+type ClientRule struct {
+	// Network matches the IP of the client, any client if it is nil
+	Network *net.IPNet
+	// Deny denies the matched clients instead of allowing them
+	Deny bool
+}
+
+// clientAllowed reports whether the first matching client rule allows ip,
+// a client that no rule matches is allowed.
+func (s *Server) clientAllowed(ip net.IP) bool {
+	for _, r := range s.ClientRules {
+		if r.Network == nil || (ip != nil && r.Network.Contains(ip)) {
+			return !r.Deny
+		}
+	}
+	return true
+}
+
+// RewriteRule redirects the destinations it matches. Server.Rules, including
+// the recheck with a sniffed hostname, apply to the destination sent by the
+// client, not to the rewritten one, so a rewrite cannot bypass or trip a rule.
+type RewriteRule struct {
+	DestinationMatch
+	// To is the new destination as "host:port",
+	// the original host or port is kept if either is empty
+	To string
+}
+
+// Rewrite returns the new destination for addr.
+func (r *RewriteRule) Rewrite(addr *protocol.Addr) (*protocol.Addr, error) {
+	host, port, err := net.SplitHostPort(r.To)
+	if err != nil {
+		return nil, err
+	}
+	dest := &address{
+		Name: addr.Name,
+		IP:   addr.IP,
+		Port: addr.Port,
+	}
+	if host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			dest.Name = ""
+			dest.IP = ip
+		} else {
+			dest.Name = host
+			dest.IP = nil
+		}
+	}
+	if port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		if p < 1 || p > 0xffff {
+			return nil, fmt.Errorf("port number out of range %s", port)
+		}
+		dest.Port = p
+	}
+	return dest, nil
+}
+
+// rewrite applies the first matching rewrite rule to the destination of req.
+func (s *Server) rewrite(req *Request) error {
+	for i := range s.Rewrites {
+		rule := &s.Rewrites[i]
+		if !rule.Match(req.DestinationAddr) {
+			continue
+		}
+		dest, err := rule.Rewrite(req.DestinationAddr)
+		if err != nil {
+			return fmt.Errorf("rewrite %v to %q failed: %w", req.DestinationAddr, rule.To, err)
+		}
+		req.OriginalDestinationAddr = req.DestinationAddr
+		req.DestinationAddr = dest
+		if s.Logger != nil {
+			s.Logger.Println("rewrite", req.OriginalDestinationAddr, "to", req.DestinationAddr)
+		}
+		return nil
+	}
+	return nil
+}
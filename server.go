@@ -1,13 +1,18 @@
 package socks4
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http/httptrace"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/wzshiming/socks4/protocol"
 )
 
 // Server is accepting connections and handling the details of the SOCKS4 protocol
@@ -24,14 +29,92 @@ type Server struct {
 	ListenBindReuseTimeout time.Duration
 	// ListenBindAcceptTimeout is the timeout for accepting connections on bind listener
 	ListenBindAcceptTimeout time.Duration
+	// StrictBind follows the SOCKS4 spec for BIND: DSTIP is the IP the peer
+	// must connect from, unless it is 0.0.0.0, and the server listens on an
+	// ephemeral port of its own instead of DSTIP:DSTPORT
+	StrictBind bool
+	// BindWaitForPeer keeps a StrictBind listener accepting after a peer from
+	// another IP, until ListenBindAcceptTimeout, instead of failing the request
+	BindWaitForPeer bool
+	// BindIP is the local IP BIND listeners are allocated on, instead of
+	// DSTIP:DSTPORT, if it is not nil. It selects the interface peers connect to
+	BindIP net.IP
+	// BindPorts is the range of ports BIND listeners are allocated from,
+	// instead of DSTIP:DSTPORT, if it is not nil
+	BindPorts *PortRange
+	// AdvertiseIP is the IPv4 address sent in the granted replies of CONNECT
+	// and in the first reply of BIND instead of the local IP, if it is not
+	// nil, for servers behind NAT
+	AdvertiseIP net.IP
+	// bindPortNext is the offset in BindPorts of the next BIND listener.
+	bindPortNext atomic.Uint32
 	// reserveListenBind is a pool for reusing bind listeners across requests.
 	reserveListenBind reserveListen
+	// virtual is the registry of virtual destinations.
+	virtual virtualRegistry
+	// sessions is the registry of active sessions.
+	sessions sessionRegistry
+	// dialStats counts the failed CONNECTs by class.
+	dialStats dialStats
 	// Logger error log
 	Logger Logger
-	// Context is default context
+	// Context is the parent of the context of every session, cancelling it
+	// ends the sessions. The context of a session is passed to ProxyDial and
+	// ProxyListenBind, see SessionIDFromContext and the other accessors
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool BytesPool
+	// MaxUserIDLength is the maximum length of USERID in a request,
+	// protocol.DefaultMaxUserIDLength is used if it is zero
+	MaxUserIDLength int
+	// MaxHostnameLength is the maximum length of a SOCKS4a hostname in a request,
+	// protocol.DefaultMaxHostnameLength is used if it is zero
+	MaxHostnameLength int
+	// Rewrites are the rules to redirect CONNECT requests before dialing,
+	// the first matching rule is applied. Rules check the destination
+	// before it is rewritten
+	Rewrites []RewriteRule
+	// HandshakeTimeout is the maximum amount of time to read the request
+	// of a client, and to authenticate it through the context of the request.
+	// The default is no timeout
+	HandshakeTimeout time.Duration
+	// IdleTimeout closes tunnels without data in either direction for this
+	// long. The default is no timeout
+	IdleTimeout time.Duration
+	// DialTimeout is the maximum amount of time to resolve and dial the
+	// destination of a CONNECT. The default is no timeout
+	DialTimeout time.Duration
+	// ResetOnDialFailure closes the client connection with a TCP reset
+	// instead of a rejected reply when a CONNECT fails with these classes
+	ResetOnDialFailure []DialFailure
+	// Rules allow or deny CONNECT destinations, the first matching rule applies
+	// to both the requested destination and the sniffed hostname
+	Rules []Rule
+	// Sniff peeks at the first bytes of CONNECT tunnels for the TLS SNI
+	// or HTTP Host, which is checked against Rules before it reaches the target.
+	// Rules with a Host then apply to requests for a plain IP by its sniffed hostname
+	Sniff bool
+	// SniffTimeout is how long to wait for the first bytes of the client,
+	// unless the target sends first. The default is one second
+	SniffTimeout time.Duration
+	// ClientRules allow or deny clients by IP before the request is read,
+	// the first matching rule applies
+	ClientRules []ClientRule
+	// Bans temporarily bans clients that repeatedly fail if it is not nil
+	Bans *BanList
+	// Quota limits the traffic and sessions of each username if it is not nil
+	Quota *Quota
+	// Hooks are called at each stage of a session if it is not nil
+	Hooks *Hooks
+	// Tracer traces the sessions if it is not nil
+	Tracer Tracer
+	// Events receives the decisions about each session if it is not nil
+	Events EventSink
+	// Capture records the traffic of selected tunnels if it is not nil
+	Capture *Capture
+	// Handlers are the handlers for requests by command,
+	// DefaultHandler is used for commands without a handler
+	Handlers map[Command]Handler
 }
 
 type Logger interface {
@@ -68,146 +151,423 @@ func (s *Server) Serve(l net.Listener) error {
 
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) {
-	defer conn.Close()
-	err := s.serveConn(conn)
+	id := newSessionID()
+	ctx, cancel := context.WithCancel(s.context())
+	defer cancel()
+	ctx = withSession(ctx, &sessionContext{id: id, client: conn.RemoteAddr()})
+	ctx, span := startSpan(s.Tracer, ctx, SpanSession)
+	req := &Request{
+		ID:   id,
+		Conn: conn,
+		ctx:  ctx,
+	}
+	span.SetAttribute("session", req.ID)
+	span.SetAttribute("client", conn.RemoteAddr().String())
+	ip := addrIP(conn.RemoteAddr())
+	if err := s.admit(ip); err != nil {
+		conn.Close()
+		span.End(err)
+		s.emit(req, EventDenied, "", err)
+		if s.Logger != nil {
+			s.Logger.Println(phaseError(PhaseAccept, fmt.Errorf("%v: %w", conn.RemoteAddr(), err)))
+		}
+		return
+	}
+	if s.Hooks != nil && s.Hooks.OnAccept != nil {
+		if err := s.Hooks.OnAccept(conn); err != nil {
+			conn.Close()
+			span.End(err)
+			s.emit(req, EventDenied, "", err)
+			if s.Logger != nil {
+				s.Logger.Println(phaseError(PhaseAccept, fmt.Errorf("%v: %w", conn.RemoteAddr(), err)))
+			}
+			return
+		}
+	}
+	start := time.Now()
+	s.sessions.add(req, start, cancel)
+	s.emit(req, EventAccepted, "", nil)
+	err := s.serveConn(req)
+	if !req.hijacked {
+		req.Conn.Close()
+	}
+	s.sessions.remove(req.ID)
+	span.End(err)
+	if s.Hooks != nil && s.Hooks.OnClose != nil {
+		s.Hooks.OnClose(req, SessionStats{
+			Start:       start,
+			Duration:    time.Since(start),
+			BytesIn:     req.counters.in.Load(),
+			BytesOut:    req.counters.out.Load(),
+			DialFailure: req.dialFailure,
+			SniffedHost: req.SniffedHost,
+			Err:         err,
+		})
+	}
+	s.emit(req, EventClosed, "", err)
+	if s.Bans != nil && ip != nil && isClientFault(err) {
+		if until, ok := s.Bans.fail(ip); ok && s.Logger != nil {
+			s.Logger.Println("ban", ip, "until", until.Format(time.RFC3339))
+		}
+	}
 	if err != nil && s.Logger != nil && !isClosedConnError(err) {
 		s.Logger.Println(err)
 	}
 }
 
-func (s *Server) serveConn(conn net.Conn) error {
-	version, err := readByte(conn)
-	if err != nil {
-		return err
-	}
-	if version != socks4Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version)
+// admit checks the client IP against ClientRules and Bans.
+func (s *Server) admit(ip net.IP) error {
+	if !s.clientAllowed(ip) {
+		return ErrClientDenied
 	}
-	req := &request{
-		Version: socks4Version,
-		Conn:    conn,
+	if s.Bans != nil && ip != nil && s.Bans.Banned(ip) {
+		return ErrClientBanned
 	}
+	return nil
+}
 
-	cmd, err := readByte(conn)
-	if err != nil {
-		return err
+// serveConn reads the request on req.Conn into req and handles it.
+func (s *Server) serveConn(req *Request) error {
+	conn := req.Conn
+	limits := protocol.Limits{
+		MaxUserIDLength:   s.MaxUserIDLength,
+		MaxHostnameLength: s.MaxHostnameLength,
+	}
+	var deadline time.Time
+	if s.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(s.HandshakeTimeout)
+		conn.SetReadDeadline(deadline)
+	}
+	_, span := startSpan(s.Tracer, req.Context(), SpanHandshake)
+	br := bufio.NewReaderSize(conn, handshakeBufferSize)
+	r, err := limits.ReadRequest(br)
+	span.End(err)
+	if s.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
 	}
-	req.Command = Command(cmd)
-
-	addr, err := readAddrAndUser(conn)
 	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if errors.Is(err, protocol.ErrInvalidVersion) {
+			return phaseError(PhaseHandshake, err)
+		}
+		if err := sendReply(conn, RejectedReply, nil); err != nil {
+			return phaseError(PhaseHandshake, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return phaseError(PhaseHandshake, err)
+	}
+	if br.Buffered() != 0 {
+		// The client sent data ahead of the reply, keep it for the tunnel.
+		req.Conn = &bufferedConn{Conn: conn, r: br}
+	}
+	req.Version = socks4Version
+	req.Command = r.Command
+	req.DestinationAddr = &r.Addr
+	req.Username = r.UserID
+	_, span = startSpan(s.Tracer, req.Context(), SpanAuth)
+	if !s.authenticateBy(req, deadline) {
+		span.End(ErrUserAuthFailed)
+		s.emit(req, EventAuthFailed, "", nil)
+		if err := sendReply(req.Conn, InvalidUserReply, nil); err != nil {
+			return phaseError(PhaseAuth, fmt.Errorf("failed to send reply: %v", err))
+		}
+		return phaseError(PhaseAuth, ErrUserAuthFailed)
+	}
+	if s.Quota != nil {
+		if err := s.Quota.check(req.Username); err != nil {
+			span.End(err)
+			s.emit(req, EventDenied, "", err)
+			if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+				return phaseError(PhaseAuth, fmt.Errorf("failed to send reply: %v", err))
+			}
+			return phaseError(PhaseAuth, err)
 		}
-		return err
 	}
-	req.DestinationAddr = &addr.address
-	req.Username = addr.Username
-	if s.Authentication != nil && !s.Authentication.Auth(req.Command, req.Username) {
-		if err := sendReply(req.Conn, invalidUserReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+	span.End(nil)
+	s.sessions.update(req)
+	s.emit(req, EventAuthenticated, "", nil)
+	if s.Hooks != nil && s.Hooks.OnRequest != nil {
+		if err := s.Hooks.OnRequest(req); err != nil {
+			s.emit(req, EventDenied, "", err)
+			if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+				return phaseError(PhaseAuth, fmt.Errorf("failed to send reply: %v", err))
+			}
+			return phaseError(PhaseAuth, fmt.Errorf("request rejected: %w", err))
 		}
-		return errUserAuthFailed
 	}
-	return s.handle(req)
+	// OnRequest may have changed the request.
+	s.sessions.update(req)
+	req.ctx = withSession(req.ctx, &sessionContext{
+		id:          req.ID,
+		client:      conn.RemoteAddr(),
+		username:    req.Username,
+		destination: req.DestinationAddr,
+	})
+	return s.handler(req.Command).ServeSOCKS4(req)
 }
 
-func (s *Server) handle(req *request) error {
-	switch req.Command {
-	case ConnectCommand:
-		return s.handleConnect(req)
-	case BindCommand:
-		return s.handleBind(req)
-	default:
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return err
+func (s *Server) handleConnect(req *Request) error {
+	ctx := req.Context()
+	// Rules on hostnames wait for the sniffed hostname of a plain IP.
+	allow, decided := s.decide(req.DestinationAddr, s.Sniff && req.DestinationAddr.Name == "")
+	if !allow {
+		s.emit(req, EventDenied, "", ErrDenied)
+		return s.failDial(req, ErrDenied)
+	}
+
+	err := s.rewrite(req)
+	if err != nil {
+		if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+			return phaseError(PhaseDial, fmt.Errorf("failed to send reply: %v", err))
 		}
-		return fmt.Errorf("unsupported Command: %v", req.Command)
+		return phaseError(PhaseDial, err)
 	}
-}
+	s.sessions.update(req)
 
-func (s *Server) handleConnect(req *request) error {
-	ctx := s.context()
-	target, err := s.proxyDial(ctx, "tcp", req.DestinationAddr.Address())
+	var target net.Conn
+	dialCtx := ctx
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+	dialCtx, span := startSpan(s.Tracer, dialCtx, SpanDial)
+	span.SetAttribute("destination", req.DestinationAddr.Address())
+	if l := s.virtual.lookup(req.DestinationAddr); l != nil {
+		target, err = l.dial(dialCtx, req.Conn.RemoteAddr())
+	} else {
+		target, err = s.dialDestination(dialCtx, req.DestinationAddr)
+	}
+	span.End(err)
 	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		s.emit(req, EventDialFailed, "", err)
+		return s.failDial(req, err)
+	}
+
+	if s.Hooks != nil && s.Hooks.OnDial != nil {
+		conn, err := s.Hooks.OnDial(req, target)
+		if err != nil {
+			target.Close()
+			s.emit(req, EventDenied, "", err)
+			return s.failDial(req, &DialError{Class: DialPolicy, Err: err})
+		}
+		target = conn
+	}
+	if s.Quota != nil {
+		if req.quota, err = s.Quota.begin(req.Username); err != nil {
+			target.Close()
+			s.emit(req, EventDenied, "", err)
+			return s.failDial(req, &DialError{Class: DialPolicy, Err: err})
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
 	}
 
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, grantedReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	s.emit(req, EventConnected, "", nil)
+	if err := s.sendGranted(req, s.advertise(replyAddr(target.LocalAddr()))); err != nil {
+		target.Close()
+		return phaseError(PhaseDial, fmt.Errorf("failed to send reply: %v", err))
 	}
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
-		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+	if s.Sniff {
+		target = s.sniff(req, target)
+		s.sessions.update(req)
+		if req.SniffedHost != "" && s.Logger != nil {
+			s.Logger.Println("sniffed", req.SniffedHost, "for", req.destination())
+		}
+		dest := req.requestedDestination()
+		if req.SniffedHost != "" {
+			dest = req.sniffedDestination()
+		} else if decided {
+			dest = nil
+		}
+		if dest != nil && !s.allowed(dest) {
+			// The reply is already sent, so the client only sees the
+			// connection closed, or reset with ResetOnDialFailure.
+			s.emit(req, EventDenied, req.SniffedHost, ErrDenied)
+			target.Close()
+			s.recordDialFailure(req, DialPolicy)
+			if s.resetOn(DialPolicy) {
+				resetConn(req.Conn)
+			}
+			return phaseError(PhaseTunnel, fmt.Errorf("connect to %v as %q failed: %w", req.destination(), req.SniffedHost, &DialError{Class: DialPolicy, Err: ErrDenied}))
+		}
 	}
-	return tunnel(ctx, target, req.Conn, buf1, buf2)
+
+	client, target, done := s.captureSession(req, req.Conn, target, req.DestinationAddr)
+	defer done()
+	return phaseError(PhaseTunnel, s.tunnel(ctx, req, target, client))
 }
 
-func (s *Server) handleBind(req *request) error {
-	ctx := s.context()
+func (s *Server) handleBind(req *Request) error {
+	ctx := req.Context()
 	addr := req.DestinationAddr.String()
 
 	var listener net.Listener
 	var err error
-	if s.ListenBindReuseTimeout > 0 {
-		listener, err = s.reserveListenBind.getOrNew(addr, func() (net.Listener, error) {
-			return s.proxyListenBind(ctx, "tcp", addr)
-		}, s.ListenBindReuseTimeout, s.ListenBindAcceptTimeout, s.Logger)
+	listenCtx, span := startSpan(s.Tracer, ctx, SpanDial)
+	listen := func() (net.Listener, error) {
+		if s.bindAllocated() {
+			return s.allocateListenBind(listenCtx)
+		}
+		return s.proxyListenBind(listenCtx, "tcp", addr)
+	}
+	if s.StrictBind {
+		// DSTIP names the peer, the listener is the server's choice and
+		// is not shared, since its peers are checked per request.
+		if s.bindAllocated() {
+			listener, err = s.allocateListenBind(listenCtx)
+		} else {
+			listener, err = s.proxyListenBind(listenCtx, "tcp", strictBindAddress)
+		}
+	} else if s.ListenBindReuseTimeout > 0 {
+		listener, err = s.reserveListenBind.getOrNew(addr, listen, s.ListenBindReuseTimeout, s.ListenBindAcceptTimeout, s.Logger)
 	} else {
-		listener, err = s.proxyListenBind(ctx, "tcp", addr)
+		listener, err = listen()
 	}
+	span.End(err)
 	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		s.emit(req, EventDialFailed, "", err)
+		if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+			return phaseError(PhaseBind, fmt.Errorf("failed to send reply: %v", err))
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return phaseError(PhaseBind, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
 
 	localAddr := listener.Addr()
 	local, ok := localAddr.(*net.TCPAddr)
 	if !ok {
 		listener.Close()
-		return fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String())
+		return phaseError(PhaseBind, fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String()))
+	}
+	if s.Hooks != nil && s.Hooks.OnBindListen != nil {
+		if err := s.Hooks.OnBindListen(req, listener); err != nil {
+			listener.Close()
+			s.emit(req, EventDenied, "", err)
+			if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+				return phaseError(PhaseBind, fmt.Errorf("failed to send reply: %v", err))
+			}
+			return phaseError(PhaseBind, fmt.Errorf("bind for %v failed: %w", req.DestinationAddr, err))
+		}
+	}
+	if s.Quota != nil {
+		if req.quota, err = s.Quota.begin(req.Username); err != nil {
+			listener.Close()
+			s.emit(req, EventDenied, "", err)
+			if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+				return phaseError(PhaseBind, fmt.Errorf("failed to send reply: %v", err))
+			}
+			return phaseError(PhaseBind, fmt.Errorf("bind for %v failed: %w", req.DestinationAddr, err))
+		}
 	}
 	bind := address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, grantedReply, &bind); err != nil {
+	s.emit(req, EventBindOpened, local.String(), nil)
+	if err := s.sendGranted(req, s.advertise(&bind)); err != nil {
 		listener.Close()
-		return fmt.Errorf("failed to send reply: %v", err)
+		return phaseError(PhaseBind, fmt.Errorf("failed to send reply: %v", err))
 	}
 
-	conn, err := listener.Accept()
+	_, span = startSpan(s.Tracer, ctx, SpanBindAccept)
+	conn, err := s.acceptBindPeer(ctx, req, listener)
+	span.End(err)
 	if err != nil {
 		listener.Close()
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+			return phaseError(PhaseBind, fmt.Errorf("failed to send reply: %v", err))
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return phaseError(PhaseBind, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
 	listener.Close()
 
 	remoteAddr := conn.RemoteAddr()
 	local, ok = remoteAddr.(*net.TCPAddr)
 	if !ok {
-		return fmt.Errorf("connect to %v failed: remote address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String())
+		return phaseError(PhaseBind, fmt.Errorf("connect to %v failed: remote address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String()))
+	}
+	if s.Hooks != nil && s.Hooks.OnBindAccept != nil {
+		if err := s.Hooks.OnBindAccept(req, conn); err != nil {
+			conn.Close()
+			s.emit(req, EventDenied, remoteAddr.String(), err)
+			if err := sendReply(req.Conn, RejectedReply, nil); err != nil {
+				return phaseError(PhaseBind, fmt.Errorf("failed to send reply: %v", err))
+			}
+			return phaseError(PhaseBind, fmt.Errorf("peer %v of bind for %v rejected: %w", remoteAddr, req.DestinationAddr, err))
+		}
 	}
 	bind = address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, grantedReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	s.emit(req, EventBindAccepted, local.String(), nil)
+	if err := s.sendGranted(req, &bind); err != nil {
+		return phaseError(PhaseBind, fmt.Errorf("failed to send reply: %v", err))
+	}
+
+	client, conn, done := s.captureSession(req, req.Conn, conn, nil)
+	defer done()
+	return phaseError(PhaseTunnel, s.tunnel(ctx, req, conn, client))
+}
+
+// strictBindAddress is where StrictBind listens.
+const strictBindAddress = "0.0.0.0:0"
+
+// acceptBindPeer accepts the peer of a BIND. With StrictBind, peers from
+// other IPs than DSTIP are dropped, and either fail the request or are
+// skipped with BindWaitForPeer.
+//
+// The listener is closed when the session ends, so that a cancelled session
+// does not wait for its peer.
+func (s *Server) acceptBindPeer(ctx context.Context, req *Request, listener net.Listener) (net.Conn, error) {
+	var timedOut atomic.Bool
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var timeout <-chan time.Time
+		if s.StrictBind && s.ListenBindAcceptTimeout > 0 {
+			timer := time.NewTimer(s.ListenBindAcceptTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		case <-timeout:
+			timedOut.Store(true)
+		}
+		listener.Close()
+	}()
+
+	want := req.DestinationAddr.IP
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if timedOut.Load() {
+				return nil, fmt.Errorf("no peer from %v within %v: %w", want, s.ListenBindAcceptTimeout, ErrBindPeerMismatch)
+			}
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("waiting for peer: %w", ctx.Err())
+			}
+			return nil, err
+		}
+		if !s.StrictBind {
+			return conn, nil
+		}
+		ip := addrIP(conn.RemoteAddr())
+		if want == nil || want.IsUnspecified() || want.Equal(ip) {
+			return conn, nil
+		}
+		conn.Close()
+		s.emit(req, EventDenied, conn.RemoteAddr().String(), ErrBindPeerMismatch)
+		if s.Logger != nil {
+			s.Logger.Println("bind for", req.DestinationAddr, "dropped peer", conn.RemoteAddr(), "not from", want)
+		}
+		if !s.BindWaitForPeer {
+			return nil, fmt.Errorf("peer %v: %w", conn.RemoteAddr(), ErrBindPeerMismatch)
+		}
 	}
+}
+
+// tunnel copies data between the target and the client until either side is
+// closed, the context is done or no data flows for IdleTimeout.
+func (s *Server) tunnel(ctx context.Context, req *Request, target, client net.Conn) (err error) {
+	_, span := startSpan(s.Tracer, ctx, SpanTunnel)
+	defer func() {
+		span.End(err)
+	}()
 
 	var buf1, buf2 []byte
 	if s.BytesPool != nil {
@@ -221,7 +581,35 @@ func (s *Server) handleBind(req *request) error {
 		buf1 = make([]byte, 32*1024)
 		buf2 = make([]byte, 32*1024)
 	}
-	return tunnel(ctx, conn, req.Conn, buf1, buf2)
+
+	target = &countConn{Conn: target, n: &req.counters.out}
+	client = &countConn{Conn: client, n: &req.counters.in}
+
+	if req.quota != nil {
+		limit := s.Quota.limit(req.Username).Bytes
+		target = &quotaConn{Conn: target, quota: s.Quota, usage: req.quota, limit: limit}
+		client = &quotaConn{Conn: client, quota: s.Quota, usage: req.quota, limit: limit}
+	}
+
+	if req.RateLimit > 0 {
+		target = &rateLimitedConn{Conn: target, limiter: newRateLimiter(req.RateLimit)}
+		client = &rateLimitedConn{Conn: client, limiter: newRateLimiter(req.RateLimit)}
+	}
+
+	if s.IdleTimeout <= 0 {
+		return tunnel(ctx, target, client, buf1, buf2)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := &idleTimer{timeout: s.IdleTimeout}
+	idle.touch()
+	go idle.run(ctx, cancel)
+	err = tunnel(ctx, &activityConn{Conn: target, idle: idle}, &activityConn{Conn: client, idle: idle}, buf1, buf2)
+	if idle.expired.Load() {
+		return ErrIdleTimeout
+	}
+	return err
 }
 
 func (s *Server) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
@@ -233,6 +621,40 @@ func (s *Server) proxyDial(ctx context.Context, network, address string) (net.Co
 	return proxyDial(ctx, network, address)
 }
 
+// dialDestination dials the destination of a CONNECT. Without ProxyDial,
+// the resolution of a hostname by the dialer is traced as SpanResolve.
+func (s *Server) dialDestination(ctx context.Context, dest *address) (net.Conn, error) {
+	if s.Tracer != nil && s.ProxyDial == nil && dest.Name != "" {
+		ctx = s.traceResolve(ctx, dest.Name)
+	}
+	return s.proxyDial(ctx, "tcp", dest.Address())
+}
+
+// traceResolve returns a context in which net.Dialer reports the DNS lookup
+// of host as a span.
+func (s *Server) traceResolve(ctx context.Context, host string) context.Context {
+	var mut sync.Mutex
+	var span Span
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mut.Lock()
+			defer mut.Unlock()
+			if span == nil {
+				_, span = startSpan(s.Tracer, ctx, SpanResolve)
+				span.SetAttribute("host", host)
+			}
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mut.Lock()
+			defer mut.Unlock()
+			if span != nil {
+				span.End(info.Err)
+				span = nil
+			}
+		},
+	})
+}
+
 func (s *Server) proxyListenBind(ctx context.Context, network, address string) (net.Listener, error) {
 	proxyListenBind := s.ProxyListenBind
 	if proxyListenBind == nil {
@@ -249,21 +671,81 @@ func (s *Server) context() context.Context {
 	return s.Context
 }
 
-func sendReply(w io.Writer, resp reply, addr *address) error {
-	_, err := w.Write([]byte{0, byte(resp)})
-	if err != nil {
-		return err
-	}
-	err = writeAddr(w, addr)
+// sendGranted sends a granted reply to the client of req.
+func (s *Server) sendGranted(req *Request, addr *address) error {
+	_, span := startSpan(s.Tracer, req.Context(), SpanReply)
+	err := sendReply(req.Conn, GrantedReply, addr)
+	span.End(err)
 	return err
 }
 
-type request struct {
-	Version         uint8
-	Command         Command
-	DestinationAddr *address
-	Username        string
-	Conn            net.Conn
+func sendReply(w io.Writer, resp ReplyCode, addr *address) error {
+	rep := &protocol.Reply{
+		Code: resp,
+	}
+	if addr != nil {
+		rep.Addr = *addr
+	}
+	return protocol.WriteReply(w, rep)
+}
+
+// handshakeBufferSize is the buffer size for reading requests,
+// which fits any request within the default limits.
+const handshakeBufferSize = 1024
+
+// bufferedConn is a net.Conn that reads the buffered data first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// idleTimer tracks the last activity of a tunnel.
+type idleTimer struct {
+	timeout    time.Duration
+	lastActive atomic.Int64
+	expired    atomic.Bool
+}
+
+func (t *idleTimer) touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+// run calls cancel once there is no activity for the timeout.
+func (t *idleTimer) run(ctx context.Context, cancel context.CancelFunc) {
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			idle := now.Sub(time.Unix(0, t.lastActive.Load()))
+			if idle >= t.timeout {
+				t.expired.Store(true)
+				cancel()
+				return
+			}
+			timer.Reset(t.timeout - idle)
+		}
+	}
+}
+
+// activityConn touches the idle timer on every read.
+type activityConn struct {
+	net.Conn
+	idle *idleTimer
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, err
 }
 
 type reserveListen struct {
@@ -280,6 +762,7 @@ type reserved struct {
 type holdListener struct {
 	r      *reserved
 	closed atomic.Bool
+	done   chan struct{}
 }
 
 func (r *reserveListen) getOrNew(key string, newFunc func() (net.Listener, error), reuse, accept time.Duration, logger Logger) (net.Listener, error) {
@@ -288,7 +771,7 @@ func (r *reserveListen) getOrNew(key string, newFunc func() (net.Listener, error
 
 	reserve := r.reservedListeners[key]
 	if reserve != nil {
-		return &holdListener{r: reserve}, nil
+		return &holdListener{r: reserve, done: make(chan struct{})}, nil
 	}
 
 	listener, err := newFunc()
@@ -315,7 +798,7 @@ func (r *reserveListen) getOrNew(key string, newFunc func() (net.Listener, error
 		}
 	}
 	go reserve.run(reuse, accept, logger)
-	return &holdListener{r: reserve}, nil
+	return &holdListener{r: reserve, done: make(chan struct{})}, nil
 }
 
 type setDeadline interface {
@@ -356,18 +839,23 @@ func (h *holdListener) Accept() (net.Conn, error) {
 	if h.closed.Load() {
 		return nil, net.ErrClosed
 	}
-	conn, ok := <-h.r.conns
-	if !ok {
-		h.closed.Store(true)
+	select {
+	case conn, ok := <-h.r.conns:
+		if !ok {
+			h.closed.Store(true)
+			return nil, net.ErrClosed
+		}
+		return conn, nil
+	case <-h.done:
 		return nil, net.ErrClosed
 	}
-	return conn, nil
 }
 
 func (h *holdListener) Close() error {
 	if h.closed.Swap(true) {
 		return net.ErrClosed
 	}
+	close(h.done)
 	return nil
 }
 
@@ -0,0 +1,182 @@
+package socks4
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionInfo describes an active session.
+type SessionInfo struct {
+	// ID is Request.ID
+	ID string
+	// Client is the address of the client
+	Client net.Addr
+	// Username, Command and Destination are empty until the request is authenticated
+	Username    string
+	Command     Command
+	Destination string
+	// SniffedHost is the TLS SNI or HTTP Host of a CONNECT, once it is sniffed
+	SniffedHost string
+	// Start is when the client connection was accepted
+	Start time.Time
+	// BytesIn is the number of bytes tunneled from the client so far
+	BytesIn int64
+	// BytesOut is the number of bytes tunneled to the client so far
+	BytesOut int64
+}
+
+// sessionRegistry tracks the active sessions of a server.
+type sessionRegistry struct {
+	mut      sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	info   SessionInfo
+	req    *Request
+	conn   net.Conn
+	cancel context.CancelFunc
+}
+
+func (r *sessionRegistry) add(req *Request, start time.Time, cancel context.CancelFunc) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.sessions == nil {
+		r.sessions = map[string]*session{}
+	}
+	r.sessions[req.ID] = &session{
+		info: SessionInfo{
+			ID:     req.ID,
+			Client: req.Conn.RemoteAddr(),
+			Start:  start,
+		},
+		req:    req,
+		conn:   req.Conn,
+		cancel: cancel,
+	}
+}
+
+// update records the request of the session once it is authenticated,
+// and again when it changes.
+func (r *sessionRegistry) update(req *Request) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if s, ok := r.sessions[req.ID]; ok {
+		s.info.Username = req.Username
+		s.info.Command = req.Command
+		s.info.Destination = req.destination()
+		s.info.SniffedHost = req.SniffedHost
+	}
+}
+
+func (r *sessionRegistry) remove(id string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	delete(r.sessions, id)
+}
+
+func (s *session) snapshot() SessionInfo {
+	info := s.info
+	info.BytesIn = s.req.counters.in.Load()
+	info.BytesOut = s.req.counters.out.Load()
+	return info
+}
+
+// Sessions returns the active sessions ordered by start time.
+func (s *Server) Sessions() []SessionInfo {
+	s.sessions.mut.Lock()
+	infos := make([]SessionInfo, 0, len(s.sessions.sessions))
+	for _, sess := range s.sessions.sessions {
+		infos = append(infos, sess.snapshot())
+	}
+	s.sessions.mut.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Start.Before(infos[j].Start)
+	})
+	return infos
+}
+
+// Session returns the active session with the ID.
+func (s *Server) Session(id string) (SessionInfo, bool) {
+	s.sessions.mut.Lock()
+	defer s.sessions.mut.Unlock()
+	sess, ok := s.sessions.sessions[id]
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return sess.snapshot(), true
+}
+
+// CancelSession ends the active session with the ID by closing its client
+// connection, and reports whether the session was found.
+func (s *Server) CancelSession(id string) bool {
+	s.sessions.mut.Lock()
+	sess, ok := s.sessions.sessions[id]
+	s.sessions.mut.Unlock()
+	if !ok {
+		return false
+	}
+	sess.cancel()
+	sess.conn.Close()
+	return true
+}
+
+type sessionContextKey struct{}
+
+// sessionContext is the metadata of a session carried by its context.
+type sessionContext struct {
+	id          string
+	client      net.Addr
+	username    string
+	destination *address
+}
+
+func withSession(ctx context.Context, sc *sessionContext) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, sc)
+}
+
+func sessionFromContext(ctx context.Context) *sessionContext {
+	sc, _ := ctx.Value(sessionContextKey{}).(*sessionContext)
+	return sc
+}
+
+// SessionIDFromContext returns the ID of the session whose context is ctx.
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	sc := sessionFromContext(ctx)
+	if sc == nil {
+		return "", false
+	}
+	return sc.id, true
+}
+
+// ClientAddrFromContext returns the client address of the session whose context is ctx.
+func ClientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	sc := sessionFromContext(ctx)
+	if sc == nil || sc.client == nil {
+		return nil, false
+	}
+	return sc.client, true
+}
+
+// UsernameFromContext returns the USERID of the session whose context is ctx,
+// once the request is authenticated.
+func UsernameFromContext(ctx context.Context) (string, bool) {
+	sc := sessionFromContext(ctx)
+	if sc == nil || sc.destination == nil {
+		return "", false
+	}
+	return sc.username, true
+}
+
+// DestinationFromContext returns the requested destination of the session
+// whose context is ctx, once the request is authenticated.
+func DestinationFromContext(ctx context.Context) (net.Addr, bool) {
+	sc := sessionFromContext(ctx)
+	if sc == nil || sc.destination == nil {
+		return nil, false
+	}
+	return sc.destination, true
+}
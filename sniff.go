@@ -0,0 +1,203 @@
+package socks4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// sniffBufferSize bounds the client bytes peeked for a hostname.
+	sniffBufferSize = 16 * 1024
+	// defaultSniffTimeout is used if Server.SniffTimeout is zero.
+	defaultSniffTimeout = time.Second
+)
+
+var errSniffIncomplete = errors.New("incomplete data")
+
+// sniff peeks at the first bytes the client sends in the tunnel and records
+// the TLS SNI or HTTP Host in req.SniffedHost, without consuming them.
+// It stops waiting once the target sends first, as SMTP, SSH and FTP servers
+// do, and returns the target with the bytes it sent.
+func (s *Server) sniff(req *Request, target net.Conn) net.Conn {
+	timeout := s.SniffTimeout
+	if timeout <= 0 {
+		timeout = defaultSniffTimeout
+	}
+	br := bufio.NewReaderSize(req.Conn, sniffBufferSize)
+	req.Conn.SetReadDeadline(time.Now().Add(timeout))
+
+	// The client of a server that speaks first waits for it,
+	// so the first bytes of the target end the wait for the client.
+	tr := bufio.NewReader(target)
+	spoke := make(chan struct{})
+	go func() {
+		defer close(spoke)
+		tr.Peek(1)
+		req.Conn.SetReadDeadline(time.Now())
+	}()
+
+	for n := 1; n <= sniffBufferSize; n = br.Buffered() + 1 {
+		// The client may wait for the target to speak first,
+		// so give up after the timeout.
+		if _, err := br.Peek(n); err != nil {
+			break
+		}
+		data, _ := br.Peek(br.Buffered())
+		host, err := sniffHost(data)
+		if err == errSniffIncomplete {
+			continue
+		}
+		if err == nil {
+			req.SniffedHost = host
+		}
+		break
+	}
+
+	target.SetReadDeadline(time.Now())
+	<-spoke
+	target.SetReadDeadline(time.Time{})
+	req.Conn.SetReadDeadline(time.Time{})
+	if br.Buffered() != 0 {
+		req.Conn = &bufferedConn{Conn: req.Conn, r: br}
+	}
+	if tr.Buffered() != 0 {
+		target = &bufferedConn{Conn: target, r: tr}
+	}
+	return target
+}
+
+// sniffHost returns the hostname in a TLS ClientHello or an HTTP/1 request.
+func sniffHost(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", errSniffIncomplete
+	}
+	if data[0] == 0x16 {
+		return sniffTLS(data)
+	}
+	return sniffHTTP(data)
+}
+
+// sniffTLS returns the server name of a ClientHello.
+func sniffTLS(data []byte) (string, error) {
+	if len(data) < 5 {
+		return "", errSniffIncomplete
+	}
+	recordLen := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5+recordLen {
+		return "", errSniffIncomplete
+	}
+	// Only the first record is parsed, which holds the whole ClientHello in practice.
+	hello := data[5 : 5+recordLen]
+	if len(hello) < 4 || hello[0] != 0x01 {
+		return "", errors.New("not a ClientHello")
+	}
+	helloLen := int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3])
+	if len(hello) < 4+helloLen {
+		return "", errors.New("fragmented ClientHello")
+	}
+	r := tlsReader(hello[4 : 4+helloLen])
+	if !r.skip(2+32) || !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return "", errors.New("malformed ClientHello")
+	}
+	extensions, ok := r.vector(2)
+	if !ok {
+		return "", errors.New("no extensions")
+	}
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions[0:2])
+		extensions = extensions[2:]
+		ext, ok := extensions.vector(2)
+		if !ok {
+			break
+		}
+		if typ != 0 {
+			continue
+		}
+		names, ok := ext.vector(2)
+		if !ok {
+			break
+		}
+		for len(names) >= 3 {
+			nameType := names[0]
+			names = names[1:]
+			name, ok := names.vector(2)
+			if !ok {
+				break
+			}
+			if nameType == 0 {
+				return string(name), nil
+			}
+		}
+		break
+	}
+	return "", errors.New("no server name")
+}
+
+// tlsReader reads the fields of a TLS handshake message.
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// vector reads a vector with an n bytes length prefix.
+func (r *tlsReader) vector(n int) (tlsReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	var l int
+	for _, b := range (*r)[:n] {
+		l = l<<8 | int(b)
+	}
+	if len(*r) < n+l {
+		return nil, false
+	}
+	v := (*r)[n : n+l]
+	*r = (*r)[n+l:]
+	return v, true
+}
+
+func (r *tlsReader) skipVector(n int) bool {
+	_, ok := r.vector(n)
+	return ok
+}
+
+// sniffHTTP returns the Host header of an HTTP/1 request.
+func sniffHTTP(data []byte) (string, error) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(data) >= sniffBufferSize {
+			return "", errors.New("header too long")
+		}
+		// Bail out early for protocols other than HTTP.
+		if i := bytes.IndexByte(data, ' '); i < 0 && len(data) > 16 || i == 0 {
+			return "", errors.New("not HTTP")
+		}
+		return "", errSniffIncomplete
+	}
+	lines := strings.Split(string(data[:end]), "\r\n")
+	if !strings.Contains(lines[0], " HTTP/1.") {
+		return "", errors.New("not HTTP/1")
+	}
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(line[:i], "Host") {
+			continue
+		}
+		host := strings.TrimSpace(line[i+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host, nil
+	}
+	return "", errors.New("no Host header")
+}
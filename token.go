@@ -0,0 +1,164 @@
+package socks4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTokenInvalid is returned when a USERID token is malformed or its signature does not verify.
+	ErrTokenInvalid = errors.New("invalid token")
+	// ErrTokenExpired is returned when a USERID token is past its expiry.
+	ErrTokenExpired = errors.New("token expired")
+)
+
+const tokenVersion = "v1"
+
+// Token is the content of a signed USERID token.
+type Token struct {
+	// Principal is who the token was issued to
+	Principal string
+	// Expiry is when the token stops being valid
+	Expiry time.Time
+	// Scopes are the commands the token allows, "connect" and "bind",
+	// every command is allowed if it is empty
+	Scopes []string
+}
+
+type tokenPayload struct {
+	Principal string   `json:"p"`
+	Expiry    int64    `json:"e"`
+	Scopes    []string `json:"s,omitempty"`
+}
+
+// MintToken returns a USERID token for tok signed with HMAC-SHA256 by key,
+// keyID names the key for verification and must not contain a dot.
+// The key must not be empty and tok must have an Expiry.
+// Use it as Dialer.Username; the server must allow USERIDs of its length,
+// see Server.MaxUserIDLength.
+func MintToken(keyID string, key []byte, tok Token) (string, error) {
+	if keyID == "" || strings.Contains(keyID, ".") {
+		return "", errors.New("key ID must be non-empty and must not contain a dot")
+	}
+	if len(key) == 0 {
+		return "", errors.New("key must not be empty")
+	}
+	if tok.Expiry.IsZero() {
+		return "", errors.New("token must have an expiry")
+	}
+	payload, err := json.Marshal(tokenPayload{
+		Principal: tok.Principal,
+		Expiry:    tok.Expiry.Unix(),
+		Scopes:    tok.Scopes,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := tokenVersion + "." + keyID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(key, signed)), nil
+}
+
+func tokenMAC(key []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// TokenAuth is an Authentication that accepts USERIDs minted by MintToken.
+// The server replaces the USERID of an authenticated request with the
+// principal of its token, so the token is not logged or kept in events,
+// sessions and quotas.
+//
+// Keys are rotated by adding the new key, minting tokens with it, and
+// removing the old key once the tokens signed by it have expired.
+type TokenAuth struct {
+	// Keys are the verification keys by key ID
+	Keys map[string][]byte
+	// Now returns the current time, the default is time.Now
+	Now func() time.Time
+}
+
+// Verify checks the signature and the expiry of the token and returns its content.
+func (a *TokenAuth) Verify(token string) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] != tokenVersion {
+		return nil, ErrTokenInvalid
+	}
+	key, ok := a.Keys[parts[1]]
+	if !ok {
+		return nil, ErrTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	signed := token[:len(token)-len(parts[3])-1]
+	if !hmac.Equal(sig, tokenMAC(key, signed)) {
+		return nil, ErrTokenInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	var payload tokenPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	tok := &Token{
+		Principal: payload.Principal,
+		Expiry:    time.Unix(payload.Expiry, 0),
+		Scopes:    payload.Scopes,
+	}
+	now := time.Now
+	if a.Now != nil {
+		now = a.Now
+	}
+	if !now().Before(tok.Expiry) {
+		return nil, ErrTokenExpired
+	}
+	return tok, nil
+}
+
+// Auth reports whether username is a valid token that allows the command.
+func (a *TokenAuth) Auth(cmd Command, username string) bool {
+	tok, err := a.Verify(username)
+	return err == nil && tok.allows(cmd)
+}
+
+// AuthRequest authenticates req like Auth and replaces req.Username with
+// the principal of the token, or with nothing if the token does not verify.
+func (a *TokenAuth) AuthRequest(req *Request) bool {
+	tok, err := a.Verify(req.Username)
+	if err != nil {
+		req.Username = ""
+		return false
+	}
+	req.Username = tok.Principal
+	return tok.allows(req.Command)
+}
+
+// allows reports whether the scopes of the token allow the command.
+func (tok *Token) allows(cmd Command) bool {
+	if len(tok.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range tok.Scopes {
+		switch strings.ToLower(scope) {
+		case "connect":
+			if cmd == ConnectCommand {
+				return true
+			}
+		case "bind":
+			if cmd == BindCommand {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package socks4
+
+import (
+	"context"
+)
+
+// Span names of the server.
+const (
+	// SpanSession is the whole session of a client connection,
+	// the parent of the other server spans
+	SpanSession = "socks4.session"
+	// SpanHandshake is reading the request of the client
+	SpanHandshake = "socks4.handshake"
+	// SpanAuth is Authentication and Quota
+	SpanAuth = "socks4.auth"
+	// SpanResolve is resolving the hostname of a SOCKS4a CONNECT
+	SpanResolve = "socks4.resolve"
+	// SpanDial is dialing the destination of a CONNECT,
+	// or listening for a BIND
+	SpanDial = "socks4.dial"
+	// SpanBindAccept is waiting for the peer of a BIND
+	SpanBindAccept = "socks4.bind_accept"
+	// SpanReply is writing a granted reply to the client
+	SpanReply = "socks4.reply"
+	// SpanTunnel is the lifetime of the tunnel
+	SpanTunnel = "socks4.tunnel"
+)
+
+// Span names of the Dialer.
+const (
+	// SpanRequest is a request through the proxy server,
+	// the parent of the other Dialer spans
+	SpanRequest = "socks4.request"
+	// SpanLocalResolve is resolving the hostname locally for socks4
+	SpanLocalResolve = "socks4.local_resolve"
+	// SpanProxyDial is dialing the proxy server
+	SpanProxyDial = "socks4.proxy_dial"
+	// SpanRequestWrite is writing the request to the proxy server
+	SpanRequestWrite = "socks4.request_write"
+	// SpanReplyRead is reading the reply of the proxy server
+	SpanReplyRead = "socks4.reply_read"
+)
+
+// Tracer starts spans, it can be backed by OpenTelemetry or any other tracing system.
+//
+// Start returns a context carrying the new span, whose parent is the span
+// carried by ctx if any. The Dialer starts its spans from the context passed
+// to DialContext, so a span of the caller parents them, and the server passes
+// the context of the session to ProxyDial, so a tracing Dialer there
+// continues the trace.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation being traced.
+type Span interface {
+	// SetAttribute annotates the span
+	SetAttribute(key, value string)
+	// End finishes the span, err is the failure of the operation if any
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key, value string) {}
+func (noopSpan) End(err error)                  {}
+
+// startSpan starts a span with the tracer, which may be nil.
+func startSpan(tracer Tracer, ctx context.Context, name string) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name)
+}
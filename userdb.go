@@ -0,0 +1,213 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UserDB is an Authentication backed by a JSON file of users, such as
+//
+//	{
+//	  "classes": {"standard": 1048576},
+//	  "users": {
+//	    "alice": {"commands": ["connect", "bind"], "class": "standard"},
+//	    "bob": {
+//	      "commands": ["connect"],
+//	      "rules": [{"host": "*.example.com"}, {"deny": true}]
+//	    },
+//	    "carol": {"enabled": false}
+//	  }
+//	}
+//
+// Classes are bandwidth limits in bytes per second, applied to each direction
+// of a session, 0 means no limit. A user is enabled unless "enabled" is false
+// and is allowed every command if "commands" is omitted. Rules are matched in
+// order against the destination and allow it if none matches.
+type UserDB struct {
+	path  string
+	users atomic.Value // map[string]*dbUser
+	mut   sync.Mutex
+	mtime time.Time
+	size  int64
+}
+
+type userDBFile struct {
+	Classes map[string]int64      `json:"classes"`
+	Users   map[string]userDBUser `json:"users"`
+}
+
+type userDBUser struct {
+	Enabled  *bool        `json:"enabled"`
+	Commands []string     `json:"commands"`
+	Rules    []userDBRule `json:"rules"`
+	Class    string       `json:"class"`
+}
+
+type userDBRule struct {
+	Host string `json:"host"`
+	CIDR string `json:"cidr"`
+	Port int    `json:"port"`
+	Deny bool   `json:"deny"`
+}
+
+type dbUser struct {
+	enabled   bool
+	commands  map[Command]bool
+	rules     []Rule
+	rateLimit int64
+}
+
+// LoadUserDB loads the user database from a JSON file.
+func LoadUserDB(path string) (*UserDB, error) {
+	db := &UserDB{path: path}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload loads the file again, the current users are kept if it fails.
+func (db *UserDB) Reload() error {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	return db.reload(info)
+}
+
+func (db *UserDB) reload(info os.FileInfo) error {
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseUserDB(data)
+	if err != nil {
+		return fmt.Errorf("user database %s: %w", db.path, err)
+	}
+	db.users.Store(users)
+	db.mtime = info.ModTime()
+	db.size = info.Size()
+	return nil
+}
+
+// Watch reloads the file whenever it changes, checking every interval,
+// until ctx is done. Failed reloads are logged if logger is not nil.
+func (db *UserDB) Watch(ctx context.Context, interval time.Duration, logger Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		db.mut.Lock()
+		info, err := os.Stat(db.path)
+		if err == nil && (!info.ModTime().Equal(db.mtime) || info.Size() != db.size) {
+			err = db.reload(info)
+		}
+		db.mut.Unlock()
+		if err != nil && logger != nil {
+			logger.Println("reload user database failed:", err)
+		}
+	}
+}
+
+func parseUserDB(data []byte) (map[string]*dbUser, error) {
+	var file userDBFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]*dbUser, len(file.Users))
+	for name, u := range file.Users {
+		user := &dbUser{
+			enabled: u.Enabled == nil || *u.Enabled,
+		}
+		if u.Commands != nil {
+			user.commands = map[Command]bool{}
+			for _, c := range u.Commands {
+				switch strings.ToLower(c) {
+				case "connect":
+					user.commands[ConnectCommand] = true
+				case "bind":
+					user.commands[BindCommand] = true
+				default:
+					return nil, fmt.Errorf("user %q: unknown command %q", name, c)
+				}
+			}
+		}
+		for i, r := range u.Rules {
+			rule := Rule{
+				DestinationMatch: DestinationMatch{Host: r.Host, Port: r.Port},
+				Deny:             r.Deny,
+			}
+			if r.CIDR != "" {
+				_, network, err := net.ParseCIDR(r.CIDR)
+				if err != nil {
+					return nil, fmt.Errorf("user %q: rule %d: %w", name, i, err)
+				}
+				rule.Network = network
+			}
+			user.rules = append(user.rules, rule)
+		}
+		if u.Class != "" {
+			rate, ok := file.Classes[u.Class]
+			if !ok {
+				return nil, fmt.Errorf("user %q: unknown class %q", name, u.Class)
+			}
+			user.rateLimit = rate
+		}
+		users[name] = user
+	}
+	return users, nil
+}
+
+func (db *UserDB) user(cmd Command, username string) (*dbUser, bool) {
+	users, _ := db.users.Load().(map[string]*dbUser)
+	u, ok := users[username]
+	if !ok || !u.enabled {
+		return nil, false
+	}
+	if u.commands != nil && !u.commands[cmd] {
+		return nil, false
+	}
+	return u, true
+}
+
+// Auth reports whether the user exists, is enabled and is allowed the command.
+func (db *UserDB) Auth(cmd Command, username string) bool {
+	_, ok := db.user(cmd, username)
+	return ok
+}
+
+// AuthRequest is Auth that also checks the rules of the user against the
+// destination and sets the rate limit of the bandwidth class of the user.
+func (db *UserDB) AuthRequest(req *Request) bool {
+	u, ok := db.user(req.Command, req.Username)
+	if !ok {
+		return false
+	}
+	for i := range u.rules {
+		if u.rules[i].Match(req.DestinationAddr) {
+			if u.rules[i].Deny {
+				return false
+			}
+			break
+		}
+	}
+	req.RateLimit = u.rateLimit
+	return true
+}
@@ -0,0 +1,155 @@
+package socks4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ListenVirtual returns a listener for a virtual destination.
+// CONNECT requests to the address, a "host:port" or "ip:port", are served
+// by accepting connections on the listener instead of being dialed.
+// Closing the listener removes the virtual destination.
+func (s *Server) ListenVirtual(addr string) (net.Listener, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dest := &address{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+	} else {
+		dest.Name = host
+	}
+	return s.virtual.listen(virtualKey(host, port), dest)
+}
+
+type virtualRegistry struct {
+	mut       sync.RWMutex
+	listeners map[string]*virtualListener
+}
+
+func (r *virtualRegistry) listen(key string, addr *address) (*virtualListener, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if _, ok := r.listeners[key]; ok {
+		return nil, fmt.Errorf("virtual destination %s already in use", addr)
+	}
+	if r.listeners == nil {
+		r.listeners = map[string]*virtualListener{}
+	}
+	l := &virtualListener{
+		r:     r,
+		key:   key,
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	r.listeners[key] = l
+	return l, nil
+}
+
+func (r *virtualRegistry) lookup(addr *address) *virtualListener {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	if len(r.listeners) == 0 {
+		return nil
+	}
+	host := addr.Name
+	if host == "" {
+		host = addr.IP.String()
+	}
+	return r.listeners[virtualKey(host, addr.Port)]
+}
+
+func (r *virtualRegistry) remove(l *virtualListener) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.listeners[l.key] == l {
+		delete(r.listeners, l.key)
+	}
+}
+
+func virtualKey(host string, port int) string {
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// virtualListener is an in-memory listener of a virtual destination.
+type virtualListener struct {
+	r     *virtualRegistry
+	key   string
+	addr  *address
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// dial connects to the listener, remote is the address of the client.
+func (l *virtualListener) dial(ctx context.Context, remote net.Addr) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	conn := &virtualConn{Conn: c2, local: l.addr, remote: remote}
+	select {
+	case l.conns <- conn:
+		return c1, nil
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	c1.Close()
+	c2.Close()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("virtual destination %s: %w", l.addr, net.ErrClosed)
+}
+
+// Accept waits for and returns the next connection to the virtual destination.
+func (l *virtualListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close removes the virtual destination.
+func (l *virtualListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		l.r.remove(l)
+		close(l.done)
+		err = nil
+	})
+	return err
+}
+
+// Addr returns the virtual destination.
+func (l *virtualListener) Addr() net.Addr {
+	return l.addr
+}
+
+// virtualConn is the accepted side of a connection to a virtual destination.
+type virtualConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *virtualConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *virtualConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}